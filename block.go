@@ -13,6 +13,7 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -21,22 +22,11 @@ import (
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
-
-	"github.com/spr-networks/sprbus"
 )
 
-import bolt "go.etcd.io/bbolt"
-
 var log = clog.NewWithPlugin("block")
 var gDomainBucket = "domains"
-
-type BlockMetrics struct {
-	TotalQueries   int64
-	BlockedQueries int64
-	BlockedDomains int64
-}
-
-var gMetrics = BlockMetrics{}
+var gMetaBucket = "meta"
 
 type DomainValue struct {
 	List_ids []int
@@ -54,39 +44,28 @@ type Block struct {
 	config           SPRBlockConfig
 	superapi_enabled bool
 
-	Db     *bolt.DB
-	DbPath string
-	Next   plugin.Handler
+	totals  *downloadTotals //usage of the refresh in progress
+	retries *retryScheduler
+	stats   *topStats //blocked queries by domain, client and category
+
+	active     atomic.Pointer[dbHandle] //db and store answering lookups
+	DbPath     string
+	filter     atomic.Pointer[bloomFilter]  //in front of store, nil to look up everything
+	rebuilding atomic.Bool                  //set from a corrupt db until the lists are downloaded again
+	querylog   atomic.Pointer[queryLog]     //nil unless QueryLog is set
+	dnstap     atomic.Pointer[dnstapOutput] //nil unless Dnstap is set
+	Next       plugin.Handler
 }
 
 func New() *Block {
 	return &Block{
-		update: make(map[string]DomainValue),
-		stop:   make(chan struct{}),
+		update:  make(map[string]DomainValue),
+		stop:    make(chan struct{}),
+		retries: newRetryScheduler(),
+		stats:   newTopStats(),
 	}
 }
 
-type DNSBlockEvent struct {
-	ClientIP string
-	Name     string
-}
-
-type DNSOverrideEvent struct {
-	ClientIP string
-	IP       string // the new IP response
-	Name     string
-}
-
-func (i *DNSBlockEvent) String() string {
-	x, _ := json.Marshal(i)
-	return string(x)
-}
-
-func (i *DNSOverrideEvent) String() string {
-	x, _ := json.Marshal(i)
-	return string(x)
-}
-
 // rebinding code
 type EventData struct {
 	Q []dns.Question
@@ -122,17 +101,6 @@ type ResponseWriterDelay struct {
 	dns.ResponseWriter
 }
 
-type DNSBlockRebindingEvent struct {
-	ClientIP  string
-	BlockedIP string
-	Name      string
-}
-
-func (i *DNSBlockRebindingEvent) String() string {
-	x, _ := json.Marshal(i)
-	return string(x)
-}
-
 // ServeDNS implements the plugin.Handler interface.
 func (b *Block) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
@@ -142,7 +110,7 @@ func (b *Block) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	new_categories := []string{}
 	hasPermit := false
 
-	gMetrics.TotalQueries++
+	gMetrics.TotalQueries.Add(1)
 	clientIP := state.IP()
 
 	clientDnsPolicies := b.getClientDnsPolicies(clientIP)
@@ -150,18 +118,39 @@ func (b *Block) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 		ctx = context.WithValue(ctx, "DNSPolicies", clientDnsPolicies)
 	}
 
-	if b.blocked(clientIP, state.Name(), &returnIP, &returnCNAME, &hasPermit, &new_categories) {
-		gMetrics.BlockedQueries++
+	//record what decided the query once answered, in the query log when
+	//it is on. None of the calls keep the trace, it stays on the stack.
+	tr := &lookupTrace{}
+	action := gActionForwarded
+	server := metrics.WithServer(ctx)
+	start := time.Now()
+	ql := b.querylog.Load()
+	defer func() {
+		recordDecision(server, action, tr, new_categories)
+		if ql != nil {
+			ql.record(newQueryLogEntry(start, state, action, tr))
+		}
+	}()
+
+	blocked := b.blockedTrace(clientIP, state.Name(), &returnIP, &returnCNAME, &hasPermit, &new_categories, tr)
+	lookupDuration.WithLabelValues(server).Observe(time.Since(start).Seconds())
+
+	if blocked {
+		action = gActionBlocked
+		gMetrics.BlockedQueries.Add(1)
+		b.stats.record(time.Now(), clientIP, state.Name(), new_categories)
 
-		blockCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		blockCount.WithLabelValues(server).Inc()
 		log.Infof("Blocked %s", state.Name())
 
+		details := b.eventDetails(state, action, dns.RcodeNameError, tr, new_categories)
 		resp := new(dns.Msg)
 		resp.SetRcode(r, dns.RcodeNameError)
+		b.tapResponse(state, start, resp, details)
 		w.WriteMsg(resp)
 
-		event := DNSBlockEvent{state.IP(), state.Name()}
-		sprbus.PublishString("dns:block:event", event.String())
+		event := DNSBlockEvent{state.IP(), state.Name(), details}
+		b.publishEvent(gEventBlock, &event)
 		return dns.RcodeNameError, nil
 	}
 
@@ -180,40 +169,33 @@ func (b *Block) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 		name := r.Question[0].Name
 		rrType := r.Question[0].Qtype
 
-		event := DNSOverrideEvent{state.IP(), returnIP, name}
-		sprbus.PublishString("dns:override:event", event.String())
-
+		//other types are forwarded, the override only answers A and AAAA
+		hdr := dns.RR_Header{
+			Name:   name,
+			Rrtype: rrType,
+			Class:  dns.ClassINET,
+			Ttl:    1,
+		}
+		var ans dns.RR
 		if rrType == dns.TypeA {
-			ans := &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   name,
-					Rrtype: rrType,
-					Class:  dns.ClassINET,
-					Ttl:    1,
-				},
-				A: net.ParseIP(returnIP),
-			}
-
-			resp.Answer = append(resp.Answer, ans)
-			w.WriteMsg(resp)
-			return dns.RcodeSuccess, nil
+			ans = &dns.A{Hdr: hdr, A: net.ParseIP(returnIP)}
 		} else if rrType == dns.TypeAAAA {
-			ans := &dns.AAAA{
-				Hdr: dns.RR_Header{
-					Name:   name,
-					Rrtype: rrType,
-					Class:  dns.ClassINET,
-					Ttl:    1,
-				},
-				AAAA: net.ParseIP(returnIP),
-			}
+			ans = &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(returnIP)}
+		}
+
+		if ans != nil {
+			action = gActionOverride
+			details := b.eventDetails(state, action, dns.RcodeSuccess, tr, new_categories)
 
 			resp.Answer = append(resp.Answer, ans)
+			b.tapResponse(state, start, resp, details)
 			err := w.WriteMsg(resp)
 			if err != nil {
 				return dns.RcodeNameError, err
 			}
 
+			event := DNSOverrideEvent{state.IP(), returnIP, name, details}
+			b.publishEvent(gEventOverride, &event)
 			return dns.RcodeSuccess, nil
 		}
 	} else if returnCNAME != "" {
@@ -222,8 +204,8 @@ func (b *Block) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 
 		name := r.Question[0].Name
 
-		event := DNSOverrideEvent{state.IP(), returnCNAME, name}
-		sprbus.PublishString("dns:override:event", event.String())
+		action = gActionOverride
+		details := b.eventDetails(state, action, dns.RcodeSuccess, tr, new_categories)
 
 		cname := &dns.CNAME{
 			Hdr: dns.RR_Header{
@@ -236,10 +218,14 @@ func (b *Block) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 		}
 
 		resp.Answer = append(resp.Answer, cname)
+		b.tapResponse(state, start, resp, details)
 		err := w.WriteMsg(resp)
 		if err != nil {
 			return dns.RcodeNameError, err
 		}
+
+		event := DNSOverrideEvent{state.IP(), returnCNAME, name, details}
+		b.publishEvent(gEventOverride, &event)
 		return dns.RcodeSuccess, nil
 	}
 
@@ -267,12 +253,15 @@ func (b *Block) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 					ip := net.ParseIP(parts[len(parts)-1])
 					if ip != nil && b.isRebindingIP(ip) {
 						//we should block this now
+						action = gActionRebinding
+						details := b.eventDetails(state, action, dns.RcodeNameError, tr, new_categories)
 						resp := new(dns.Msg)
 						resp.SetRcode(r, dns.RcodeNameError)
+						b.tapResponse(state, start, resp, details)
 						w.WriteMsg(resp)
 
-						bus_event := DNSBlockRebindingEvent{state.IP(), ip.String(), state.Name()}
-						sprbus.PublishString("dns:blockrebind:event", bus_event.String())
+						bus_event := DNSBlockRebindingEvent{state.IP(), ip.String(), state.Name(), details}
+						b.publishEvent(gEventRebinding, &bus_event)
 
 						return dns.RcodeNameError, nil
 					}
@@ -286,6 +275,9 @@ func (b *Block) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 
 	} else {
 		//fall through
+		if hasPermit {
+			action = gActionPermitted
+		}
 		return plugin.NextOrFailure(b.Name(), b.Next, ctx, w, r)
 	}
 
@@ -294,38 +286,57 @@ func (b *Block) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 // Name implements the Handler interface.
 func (b *Block) Name() string { return "block" }
 
-func matchOverride(IP string, fullname string, name string, overrides []DomainOverride, returnIP *string, returnCNAME *string) bool {
+func matchOverride(IP string, fullname string, name string, overrides []DomainOverride, returnIP *string, returnCNAME *string, tr *lookupTrace) bool {
 
 	cur_time := time.Now().Unix()
 
 	for _, entry := range overrides {
+		//check if domain matches name to make a decision
+		if name != entry.Domain && fullname != entry.Domain {
+			continue
+		}
+
 		if entry.Expiration != 0 {
 			//this override has expired
 			if entry.Expiration <= cur_time {
+				if tr.verbose {
+					tr.add("override", name, "%s entry for %s expired", entry.Type, entry.Domain)
+				}
 				continue
 			}
 		}
 
 		if entry.ClientIP == "" || entry.ClientIP == "*" || entry.ClientIP == IP {
 			//match wildcard or match IP
-			//now check if domain matches name to make a decision
-			if name == entry.Domain || fullname == entry.Domain {
-				//got a match -> set results if available
-				if entry.ResultIP != "" {
-					*returnIP = entry.ResultIP
-				}
-				if entry.ResultCNAME != "" {
-					*returnCNAME = entry.ResultCNAME
-				}
+			//got a match -> set results if available
+			if entry.ResultIP != "" {
+				*returnIP = entry.ResultIP
+			}
+			if entry.ResultCNAME != "" {
+				*returnCNAME = entry.ResultCNAME
+			}
 
-				if len(entry.Tags) > 0 {
-					//tags were specified, make sure that the IP has one of those set
-					return IPHasTags(entry.ClientIP, entry.Tags)
+			if len(entry.Tags) > 0 {
+				//tags were specified, make sure that the IP has one of those set
+				matched := IPHasTags(entry.ClientIP, entry.Tags)
+				if tr.verbose {
+					tr.add("override", name, "%s entry for %s requires tags %v, matched: %v", entry.Type, entry.Domain, entry.Tags, matched)
 				}
+				if matched {
+					tr.matchedDomain(entry.Domain)
+				}
+				return matched
+			}
 
-				return true
+			if tr.verbose {
+				tr.add("override", name, "%s entry for %s matched", entry.Type, entry.Domain)
 			}
+			tr.matchedDomain(entry.Domain)
+			return true
+		}
 
+		if tr.verbose {
+			tr.add("override", name, "%s entry for %s applies to client %s only", entry.Type, entry.Domain, entry.ClientIP)
 		}
 	}
 
@@ -335,17 +346,19 @@ func matchOverride(IP string, fullname string, name string, overrides []DomainOv
 func (b *Block) dumpEntries(w http.ResponseWriter, r *http.Request) {
 	domains := []string{}
 
-	Dmtx.Lock()
-
-	err, items := getItems(b.Db, gDomainBucket)
-	if err != nil {
+	h := b.acquire()
+	if h == nil {
+		http.Error(w, "database not ready", 400)
+		return
+	}
+	err, items := getItems(h.db, gDomainBucket)
+	h.release()
+	if err == nil {
 		for _, v := range items {
 			domains = append(domains, v.Key)
 		}
 	}
 
-	Dmtx.Unlock()
-
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
@@ -357,6 +370,7 @@ func (b *Block) dumpEntries(w http.ResponseWriter, r *http.Request) {
 
 var IPTagMap = make(map[string][]string)
 var IPPolicyMap = make(map[string][]string)
+var IPDeviceMap = make(map[string]EventDevice)
 
 var IPTagmtx sync.RWMutex
 
@@ -401,6 +415,7 @@ func APIDevices() (map[string]DeviceEntry, error) {
 func (b *Block) updateIPTags() {
 	newMap := make(map[string][]string)
 	newPolicyMap := make(map[string][]string)
+	newDeviceMap := make(map[string]EventDevice)
 
 	devices, err := APIDevices()
 	if err != nil {
@@ -412,12 +427,14 @@ func (b *Block) updateIPTags() {
 		if entry.RecentIP != "" {
 			newMap[entry.RecentIP] = entry.DeviceTags
 			newPolicyMap[entry.RecentIP] = entry.Policies
+			newDeviceMap[entry.RecentIP] = EventDevice{entry.Name, entry.MAC}
 		}
 	}
 
 	IPTagmtx.Lock()
 	IPTagMap = newMap
 	IPPolicyMap = newPolicyMap
+	IPDeviceMap = newDeviceMap
 	IPTagmtx.Unlock()
 }
 
@@ -473,7 +490,7 @@ func IPHasTags(IP string, applied_tags []string) bool {
 	return false
 }
 
-func (b *Block) deviceMatchBlockListTags(IP string, entry DomainValue, block bool) bool {
+func (b *Block) deviceMatchBlockListTags(IP string, entry DomainValue, block bool, tr *lookupTrace) bool {
 	// a domain was blocked. Check if the list_id has a group specification.
 	// return true if there is no group specification, or the device is
 	// in the specified. If the device is not in a specified group, return false
@@ -482,12 +499,12 @@ func (b *Block) deviceMatchBlockListTags(IP string, entry DomainValue, block boo
 
 	for _, list_id := range entry.List_ids {
 
-		if list_id >= 0 && int(list_id) < len(b.config.BlockLists) {
-			if b.config.BlockLists[list_id].DontBlock == true {
+		if list, exists := b.listByIDLocked(list_id); exists {
+			if list.DontBlock == true {
 				continue
 			}
 
-			applied_tags := b.config.BlockLists[list_id].Tags
+			applied_tags := list.Tags
 
 			if len(applied_tags) == 0 {
 				//no tags specified, continue
@@ -495,43 +512,112 @@ func (b *Block) deviceMatchBlockListTags(IP string, entry DomainValue, block boo
 			}
 
 			//had tags, return true only if IP has that tag. otherwise false
-			return IPHasTags(IP, applied_tags)
+			matched := IPHasTags(IP, applied_tags)
+			if tr.verbose {
+				tr.add("tags", "", "list %d applies to tags %v, client has one: %v", list_id, applied_tags, matched)
+			}
+			return matched
 		}
 
 	}
 	//no list
+	if tr.verbose {
+		tr.add("tags", "", "no list of the domain is limited to tags")
+	}
 	return block
 }
 
+// listByIDLocked returns the configured list with list_id, with BLmtx held
+func (b *Block) listByIDLocked(list_id int) (ListEntry, bool) {
+	for _, entry := range b.config.BlockLists {
+		if entry.ID == list_id {
+			return entry, true
+		}
+	}
+	return ListEntry{}, false
+}
+
 func (b *Block) getDomain(name string) (DomainValue, bool) {
-	err, item := getItem(b.Db, gDomainBucket, name)
-	if err == nil {
-		return item.Value, true
+	return b.lookupDomain(name, true)
+}
+
+// lookupDomain finds name in the domain store, asking the domain filter
+// first. With count set the filter metrics count the lookup, explanations
+// leave them alone.
+func (b *Block) lookupDomain(name string, count bool) (DomainValue, bool) {
+	f := b.filter.Load()
+	if f != nil && !f.mayContain(name) {
+		if count {
+			gMetrics.FilterRejected.Add(1)
+		}
+		return DomainValue{}, false
+	}
+
+	h := b.acquire()
+	if h == nil {
+		return DomainValue{}, false
 	}
-	return DomainValue{}, false
+	value, found := h.store.Get(name)
+	h.release()
+	if !found && f != nil && count {
+		gMetrics.FilterFalsePositives.Add(1)
+	}
+	return value, found
 }
 
-func (b *Block) getDomainInfo(name string) (DomainValue, []string, bool, bool) {
-	entry, exists := b.getDomain(name)
+func (b *Block) getDomainInfo(name string, tr *lookupTrace) (DomainValue, []string, bool, bool) {
+	entry, exists := b.lookupDomain(name, !tr.verbose)
 	categories := []string{}
+	if !exists && tr.verbose {
+		if f := b.filter.Load(); f != nil && !f.mayContain(name) {
+			tr.add("lookup", name, "rejected by the domain filter")
+		} else {
+			tr.add("lookup", name, "not in the database")
+		}
+	}
 	if exists {
+		if tr.verbose {
+			tr.add("lookup", name, "found in lists %v", entry.List_ids)
+		}
 
 		//if all of the lists are set to DontBlock, then dont block it
 		dontBlock := true
 		sawList := false
+		applied := []int{}
 		BLmtx.RLock()
 		//get the categories from the list ids
 		for _, list_id := range entry.List_ids {
-			if list_id >= 0 && int(list_id) < len(b.config.BlockLists) {
+			list, exists := b.listByIDLocked(list_id)
+			if (exists && !list.Enabled) || (!exists && list_id >= 0 && list_id < b.config.NextListID) {
+				//disabled lists stay stored and deleted lists stay until
+				//garbage collection, neither applies
+				if tr.verbose && exists {
+					tr.add("list", name, "list %d (%s) is disabled", list_id, list.URI)
+				} else if tr.verbose {
+					tr.add("list", name, "list %d was deleted", list_id)
+				}
+				continue
+			}
+			applied = append(applied, list_id)
+			if exists {
 				sawList = true
-				cat := b.config.BlockLists[list_id].Category
+				cat := list.Category
 				if cat != "" && !slices.Contains(categories, cat) {
 					categories = append(categories, cat)
 				}
-				dontBlock = dontBlock && b.config.BlockLists[list_id].DontBlock
+				dontBlock = dontBlock && list.DontBlock
+				if tr.verbose {
+					tr.add("list", name, "list %d (%s) applies, category %q, DontBlock %v", list_id, list.URI, list.Category, list.DontBlock)
+				}
+			} else if tr.verbose {
+				tr.add("list", name, "list %d is not configured", list_id)
 			}
 		}
 		BLmtx.RUnlock()
+		if len(applied) == 0 && len(entry.List_ids) > 0 {
+			return DomainValue{}, categories, false, false
+		}
+		entry.List_ids = applied
 		//if no lists were valid assume blocking behavior.
 		if sawList == false {
 			dontBlock = false
@@ -556,27 +642,45 @@ func (b *Block) isRebindingIP(ip net.IP) bool {
 	return false
 }
 
-func (b *Block) checkBlock(IP string, name string, fullname string, returnIP *string, returnCNAME *string, hasPermit *bool, categories *[]string) bool {
+func (b *Block) checkBlock(IP string, name string, fullname string, returnIP *string, returnCNAME *string, hasPermit *bool, categories *[]string, tr *lookupTrace) bool {
 	*hasPermit = false
 	if b.superapi_enabled {
 		// do not block for excluded IPs
 		for _, excludeIP := range b.config.ClientIPExclusions {
 			if IP == excludeIP {
 				//not blocked
+				if tr.verbose {
+					tr.add("exclusion", name, "client %s is excluded from blocking", IP)
+				}
+				tr.matched("client exclusion")
 				return false
 			}
 		}
+		if tr.verbose {
+			tr.add("exclusion", name, "client %s is not excluded", IP)
+		}
 
 		if IPQuarantined(IP) {
 			//in quarantine mode, send all traffic to the QuarantineHostIP
 			if b.config.QuarantineHostIP != "" {
+				if tr.verbose {
+					tr.add("quarantine", name, "client is quarantined, answering with %s", b.config.QuarantineHostIP)
+				}
+				tr.quarantine()
 				*hasPermit = true
 				*returnIP = b.config.QuarantineHostIP
 				return false
 			}
 			//otherwise block the DNS lookup.
+			if tr.verbose {
+				tr.add("quarantine", name, "client is quarantined without a QuarantineHostIP, blocked")
+			}
+			tr.quarantine()
 			return true
 		}
+		if tr.verbose {
+			tr.add("quarantine", name, "client is not quarantined")
+		}
 
 		//go and check each override
 
@@ -584,6 +688,9 @@ func (b *Block) checkBlock(IP string, name string, fullname string, returnIP *st
 
 			//skip disabled list
 			if overrideList.Enabled == false {
+				if tr.verbose {
+					tr.add("override", name, "override list %q skipped, disabled", overrideList.Name)
+				}
 				continue
 			}
 
@@ -591,49 +698,80 @@ func (b *Block) checkBlock(IP string, name string, fullname string, returnIP *st
 			if b.superapi_enabled && len(overrideList.Tags) > 0 {
 				// client needs tags for these overrides to apply
 				if !IPHasTags(IP, overrideList.Tags) {
+					if tr.verbose {
+						tr.add("override", name, "override list %q skipped, client has none of the tags %v", overrideList.Name, overrideList.Tags)
+					}
 					continue
 				}
 			}
 
-			if matchOverride(IP, fullname, name, overrideList.PermitDomains, returnIP, returnCNAME) {
+			if matchOverride(IP, fullname, name, overrideList.PermitDomains, returnIP, returnCNAME, tr) {
 				*hasPermit = true
 				//permit this domain
+				if tr.verbose {
+					tr.add("override", name, "permitted by override list %q", overrideList.Name)
+				}
+				tr.matched(overrideList.Name)
 				return false
 			}
 
-			if matchOverride(IP, fullname, name, overrideList.BlockDomains, returnIP, returnCNAME) {
+			if matchOverride(IP, fullname, name, overrideList.BlockDomains, returnIP, returnCNAME, tr) {
 				//yes blocked
+				if tr.verbose {
+					tr.add("override", name, "blocked by override list %q", overrideList.Name)
+				}
+				tr.matched(overrideList.Name)
 				return true
 			}
+			if tr.verbose {
+				tr.add("override", name, "override list %q has no matching entry", overrideList.Name)
+			}
 		}
 
 	}
 
-	Dmtx.RLock()
-	entry, blockCategories, block, exists := b.getDomainInfo(name)
-	Dmtx.RUnlock()
+	if b.rebuilding.Load() && b.config.FailClosed {
+		//the lists are not known yet, block everything not permitted
+		if tr.verbose {
+			tr.add("lookup", name, "database is being rebuilt and FailClosed is set, blocked")
+		}
+		return true
+	}
+
+	entry, blockCategories, block, exists := b.getDomainInfo(name, tr)
 	if exists && !entry.Disabled {
+		tr.hit(name, entry.List_ids)
 		if len(blockCategories) > 0 {
 			*categories = blockCategories
 		}
 		if b.superapi_enabled {
-			return b.deviceMatchBlockListTags(IP, entry, block)
+			return b.deviceMatchBlockListTags(IP, entry, block, tr)
 		}
 		return block
 	}
+	if exists {
+		if tr.verbose {
+			tr.add("lookup", name, "domain entry is disabled")
+		}
+	}
 
 	return false
 }
 
 func (b *Block) blocked(IP string, name string, returnIP *string, returnCNAME *string, hasPermit *bool, categories *[]string) bool {
+	return b.blockedTrace(IP, name, returnIP, returnCNAME, hasPermit, categories, &lookupTrace{})
+}
 
-	if b.checkBlock(IP, name, name, returnIP, returnCNAME, hasPermit, categories) {
+// blockedTrace decides like blocked, recording every step in tr
+func (b *Block) blockedTrace(IP string, name string, returnIP *string, returnCNAME *string, hasPermit *bool, categories *[]string, tr *lookupTrace) bool {
+
+	if b.checkBlock(IP, name, name, returnIP, returnCNAME, hasPermit, categories, tr) {
 		return true
 	}
 
 	i, end := dns.NextLabel(name, 0)
 	for !end {
-		if b.checkBlock(IP, name[i:], name, returnIP, returnCNAME, hasPermit, categories) {
+		if b.checkBlock(IP, name[i:], name, returnIP, returnCNAME, hasPermit, categories, tr) {
 			return true
 		}
 		i, end = dns.NextLabel(name, i)
@@ -666,8 +804,18 @@ func (b *Block) setupDB(filename string) {
 	Dmtx.Lock()
 	defer Dmtx.Unlock()
 
-	b.Db = BoltOpen(filename)
+	db, rebuilt := openDB(filename)
 	b.DbPath = filename
+	b.setRebuilding(rebuilt)
+	b.publish(withStore(newDBRef(db), b.configuredStoreKind()))
+	b.rebuildFilterLocked()
+
+	gMetrics.BlockedDomains.Store(getCount(db, gDomainBucket))
+	b.updateDBMetrics()
+	updateListMetrics(db)
+}
 
-	gMetrics.BlockedDomains = getCount(b.Db, gDomainBucket)
+func (b *Block) setRebuilding(rebuilding bool) {
+	b.rebuilding.Store(rebuilding)
+	gMetrics.Rebuilding.Store(rebuilding)
 }
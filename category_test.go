@@ -13,25 +13,24 @@ func TestCategory(t *testing.T) {
 	b.superapi_enabled = true
 
 	b.config.BlockLists = []ListEntry{
-		{"https://raw.githubusercontent.com/blocklistproject/Lists/master/twitter.txt",
-			true,
-			[]string{},
-			"social",
-			true},
-		{"https://raw.githubusercontent.com/blocklistproject/Lists/master/facebook.txt",
-			true,
-			[]string{},
-			"social",
-			true},
-		{"https://raw.githubusercontent.com/blocklistproject/Lists/master/ads.txt",
-			true,
-			[]string{},
-			"ads",
-			false},
+		{URI: "https://raw.githubusercontent.com/blocklistproject/Lists/master/twitter.txt",
+			Enabled:   true,
+			Tags:      []string{},
+			Category:  "social",
+			DontBlock: true},
+		{URI: "https://raw.githubusercontent.com/blocklistproject/Lists/master/facebook.txt",
+			Enabled:   true,
+			Tags:      []string{},
+			Category:  "social",
+			DontBlock: true},
+		{URI: "https://raw.githubusercontent.com/blocklistproject/Lists/master/ads.txt",
+			Enabled:   true,
+			Tags:      []string{},
+			Category:  "ads",
+			DontBlock: false},
 	}
 
-	for i, entry := range b.config.BlockLists {
-		err := b.dbStagingDownload(b.Db, entry.URI, i)
+	for _, err := range b.downloadLists(nil) {
 		if err != nil {
 			log.Fatal("failed to download", err)
 		}
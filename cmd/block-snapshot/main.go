@@ -0,0 +1,171 @@
+// block-snapshot exports and imports snapshots of the block plugin
+// database through the API socket of a running instance.
+//
+//	block-snapshot export FILE
+//	block-snapshot import FILE
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-socket path] export|import FILE\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	socket := flag.String("socket", "/state/dns/dns_block_plugin", "API socket of the block plugin")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", *socket)
+			},
+		},
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "export":
+		err = export(client, flag.Arg(1))
+	case "import":
+		err = restore(client, flag.Arg(1))
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func export(client *http.Client, path string) error {
+	resp, err := client.Get("http://block/db/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("export failed: %s: %s", resp.Status, msg)
+	}
+
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = checkSnapshot(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkSnapshot reads the snapshot at path to its end. A response cut off
+// by a failure of the server misses records or the gzip trailer.
+func checkSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("export incomplete: %w", err)
+	}
+	r := bufio.NewReader(zr)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("export incomplete: %w", err)
+	}
+	header := struct{ Domains int64 }{}
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return fmt.Errorf("export incomplete: %w", err)
+	}
+
+	//records are the uvarint length and bytes of the name and the value,
+	//an empty name ends them
+	read := int64(0)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("export incomplete after %d domains: %w", read, err)
+		}
+		if n == 0 {
+			break
+		}
+		_, err = r.Discard(int(n))
+		if err == nil {
+			n, err = binary.ReadUvarint(r)
+		}
+		if err == nil {
+			_, err = r.Discard(int(n))
+		}
+		if err != nil {
+			return fmt.Errorf("export incomplete after %d domains: %w", read, err)
+		}
+		read++
+	}
+	if read != header.Domains {
+		return fmt.Errorf("export incomplete: %d domains, the header says %d", read, header.Domains)
+	}
+
+	//reading to the end checks the gzip trailer
+	_, err = io.Copy(io.Discard, r)
+	if err != nil {
+		return fmt.Errorf("export incomplete: %w", err)
+	}
+	return nil
+}
+
+func restore(client *http.Client, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	req, err := http.NewRequest("PUT", "http://block/db/snapshot", f)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	//the result lists how every list of the snapshot was handled
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("import failed: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package block
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// compaction defaults, a free ratio below gCompactMinFreeBytes is left
+// alone so small databases are not rewritten for a few pages
+var gDefaultCompactInterval = time.Hour * 24 * 7
+var gDefaultCompactFreeRatio = 0.5
+var gCompactMinFreeBytes = int64(16 << 20)
+
+// CompactResult reports a compaction run
+type CompactResult struct {
+	BeforeBytes  int64
+	AfterBytes   int64
+	Milliseconds int64
+}
+
+// dbUsage returns the size of the db file and the bytes of it on free
+// pages, with Dmtx held
+func (b *Block) dbUsage() (size int64, free int64) {
+	db := b.db()
+	if db == nil {
+		return 0, 0
+	}
+	info, err := os.Stat(db.Path())
+	if err != nil {
+		return 0, 0
+	}
+	stats := db.Stats()
+	return info.Size(), int64(stats.FreeAlloc)
+}
+
+// updateDBMetrics reports the size and fragmentation of the db, with Dmtx
+// held
+func (b *Block) updateDBMetrics() {
+	size, free := b.dbUsage()
+	gMetrics.DBBytes.Store(size)
+	gMetrics.DBFreeBytes.Store(free)
+	gMetrics.DBFreeRatio.Store(0)
+	if size > 0 {
+		gMetrics.DBFreeRatio.Store(float64(free) / float64(size))
+	}
+}
+
+// compact rewrites the db without its free pages. The new file holds the
+// pages in use, so at least that much disk space has to be available next
+// to the db. Lookups are answered from the old db during the run.
+func (b *Block) compact() (CompactResult, error) {
+	result := CompactResult{}
+	start := time.Now()
+
+	Dmtx.RLock()
+	size, free := b.dbUsage()
+	Dmtx.RUnlock()
+	if size == 0 {
+		return result, fmt.Errorf("database not ready")
+	}
+
+	needed := size - free
+	needed += needed / 10
+	available, err := diskAvailable(filepath.Dir(b.DbPath))
+	if errors.Is(err, errors.ErrUnsupported) {
+		//the space is not known here, a failed compaction keeps the db
+		available = needed
+	} else if err != nil {
+		return result, err
+	}
+	if available < needed {
+		return result, fmt.Errorf("not enough disk space to compact, %d bytes needed, %d available", needed, available)
+	}
+
+	err = b.compactDb()
+	if err != nil {
+		return result, err
+	}
+
+	Dmtx.RLock()
+	b.updateDBMetrics()
+	Dmtx.RUnlock()
+
+	result.BeforeBytes = size
+	result.AfterBytes = gMetrics.DBBytes.Load()
+	result.Milliseconds = time.Since(start).Milliseconds()
+
+	gMetrics.LastCompaction.Store(time.Now().Unix())
+	gMetrics.LastCompactionBeforeBytes.Store(result.BeforeBytes)
+	gMetrics.LastCompactionAfterBytes.Store(result.AfterBytes)
+	gMetrics.LastCompactionMilliseconds.Store(result.Milliseconds)
+
+	log.Infof("Compacted database from %d to %d bytes in %dms", result.BeforeBytes, result.AfterBytes, result.Milliseconds)
+	return result, nil
+}
+
+// compactIfFragmented compacts the db when more than CompactFreeRatio of
+// it is on free pages
+func (b *Block) compactIfFragmented() {
+	ratio := gDefaultCompactFreeRatio
+	if b.config.CompactFreeRatio > 0 {
+		ratio = b.config.CompactFreeRatio
+	}
+
+	Dmtx.RLock()
+	b.updateDBMetrics()
+	free := gMetrics.DBFreeBytes.Load()
+	over := gMetrics.DBFreeRatio.Load() > ratio
+	Dmtx.RUnlock()
+
+	if !over || free < gCompactMinFreeBytes {
+		return
+	}
+
+	_, err := b.compact()
+	if err != nil {
+		log.Warningf("Failed to compact database: %s", err)
+	}
+}
+
+// compaction compacts the db every CompactSeconds. It returns once b.stop
+// is closed.
+func (b *Block) compaction() {
+	interval := gDefaultCompactInterval
+	if b.config.CompactSeconds > 0 {
+		interval = time.Duration(b.config.CompactSeconds) * time.Second
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			_, err := b.compact()
+			if err != nil {
+				log.Warningf("Failed to compact database: %s", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *Block) compactHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := b.compact()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
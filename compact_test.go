@@ -0,0 +1,66 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompaction(t *testing.T) {
+	var version atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := version.Load()
+		for i := 0; i < 20000; i++ {
+			fmt.Fprintf(w, "0.0.0.0 host%d.v%d.example.com\n", i, v)
+		}
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/compact_test.db")
+	b := New()
+	b.setupDB("/tmp/compact_test.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{{URI: srv.URL + "/list", Enabled: true}}
+	b.config.CompactFreeRatio = 0.99
+	b.downloadLists(nil)
+
+	//replacing every domain leaves the pages of the old ones free
+	version.Add(1)
+	b.downloadLists(nil)
+	if gMetrics.DBFreeBytes.Load() == 0 || gMetrics.DBFreeRatio.Load() <= 0 {
+		t.Fatalf("expected free pages after churn, got %d bytes", gMetrics.DBFreeBytes.Load())
+	}
+
+	rr := httptest.NewRecorder()
+	b.compactHandler(rr, httptest.NewRequest("PUT", "/db/compact", nil))
+	result := CompactResult{}
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatalf("unexpected response %d: %v", rr.Code, err)
+	}
+	if result.AfterBytes >= result.BeforeBytes || gMetrics.LastCompactionAfterBytes.Load() != result.AfterBytes {
+		t.Errorf("expected the db to shrink, got %+v", result)
+	}
+	if _, found := b.getDomain("host7.v1.example.com."); !found {
+		t.Errorf("expected domains to survive the compaction")
+	}
+
+	//a refresh leaving the db fragmented compacts it
+	minFree := gCompactMinFreeBytes
+	gCompactMinFreeBytes = 0
+	defer func() { gCompactMinFreeBytes = minFree }()
+	b.config.CompactFreeRatio = 0.01
+	gMetrics.LastCompaction.Store(0)
+	version.Add(1)
+	b.downloadLists(nil)
+	if gMetrics.LastCompaction.Load() == 0 {
+		t.Errorf("expected a compaction past the free ratio")
+	}
+	if _, found := b.getDomain("host7.v2.example.com."); !found {
+		t.Errorf("expected domains to survive the compaction")
+	}
+}
@@ -0,0 +1,223 @@
+package block
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// secrets for list downloads are kept out of the world readable
+// block_rules.json
+var CREDENTIALS_PATH = TEST_PREFIX + "/configs/dns/block_credentials.json"
+
+// ListCredentials authenticate the download of a list or mirror URI. They
+// are only sent to the scheme and host of that URI.
+type ListCredentials struct {
+	URI         string
+	BearerToken string            `json:",omitempty"`
+	Username    string            `json:",omitempty"`
+	Password    string            `json:",omitempty"`
+	Headers     map[string]string `json:",omitempty"` //secret headers such as API keys
+}
+
+// ListCredentialsInfo is what the API reveals about stored credentials
+type ListCredentialsInfo struct {
+	URI         string
+	BearerToken bool
+	BasicAuth   bool
+	Headers     []string
+}
+
+var Credmtx sync.Mutex
+
+func loadCredentialsLocked() (map[string]ListCredentials, error) {
+	creds := map[string]ListCredentials{}
+
+	data, err := ioutil.ReadFile(CREDENTIALS_PATH)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return creds, nil
+		}
+		return nil, err
+	}
+
+	list := []ListCredentials{}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range list {
+		creds[entry.URI] = entry
+	}
+	return creds, nil
+}
+
+func saveCredentialsLocked(creds map[string]ListCredentials) error {
+	list := []ListCredentials{}
+	for _, entry := range creds {
+		list = append(list, entry)
+	}
+
+	file, _ := json.MarshalIndent(list, "", " ")
+	err := ioutil.WriteFile(CREDENTIALS_PATH, file, 0600)
+	if err != nil {
+		return err
+	}
+	//WriteFile keeps the mode of an existing file
+	return os.Chmod(CREDENTIALS_PATH, 0600)
+}
+
+func getListCredentials(uri string) (ListCredentials, bool) {
+	Credmtx.Lock()
+	defer Credmtx.Unlock()
+
+	creds, err := loadCredentialsLocked()
+	if err != nil {
+		log.Warningf("Failed to load list credentials: %s", err)
+		return ListCredentials{}, false
+	}
+
+	entry, exists := creds[uri]
+	return entry, exists
+}
+
+// listTransport adds the headers and credentials of a list to requests
+// for the scheme and host being downloaded from, including the digest and
+// signature files. A redirect from https to http of the same host does not
+// get them.
+type listTransport struct {
+	base        http.RoundTripper
+	scheme      string
+	host        string
+	headers     map[string]string
+	credentials ListCredentials
+}
+
+func (t *listTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != t.scheme || req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range t.credentials.Headers {
+		req.Header.Set(k, v)
+	}
+	if t.credentials.Username != "" || t.credentials.Password != "" {
+		req.SetBasicAuth(t.credentials.Username, t.credentials.Password)
+	}
+	if t.credentials.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+t.credentials.BearerToken)
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// listClient builds the http client for downloading entry from uri, the
+// list URI or one of its mirrors: the proxy of the list, else the configured
+// Proxy, else the environment. Headers and the credentials stored for uri
+// are added for the host of uri.
+func (b *Block) listClient(entry ListEntry, uri string) (*http.Client, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	proxy := entry.Proxy
+	if proxy == "" {
+		proxy = b.config.Proxy
+	}
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, errors.New("invalid proxy " + proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	credentials, _ := getListCredentials(uri)
+
+	return &http.Client{
+		Transport: &listTransport{
+			base:        transport,
+			scheme:      u.Scheme,
+			host:        u.Host,
+			headers:     entry.Headers,
+			credentials: credentials,
+		},
+	}, nil
+}
+
+func credentialsInfo(entry ListCredentials) ListCredentialsInfo {
+	info := ListCredentialsInfo{
+		URI:         entry.URI,
+		BearerToken: entry.BearerToken != "",
+		BasicAuth:   entry.Username != "" || entry.Password != "",
+		Headers:     []string{},
+	}
+	for k := range entry.Headers {
+		info.Headers = append(info.Headers, k)
+	}
+	return info
+}
+
+func (b *Block) modifyListCredentials(w http.ResponseWriter, r *http.Request) {
+	Credmtx.Lock()
+	defer Credmtx.Unlock()
+
+	creds, err := loadCredentialsLocked()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		//never hand out the secrets themselves
+		infos := []ListCredentialsInfo{}
+		for _, entry := range creds {
+			infos = append(infos, credentialsInfo(entry))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+		return
+	}
+
+	entry := ListCredentials{}
+	err = json.NewDecoder(r.Body).Decode(&entry)
+	if err == nil && entry.URI == "" {
+		err = errors.New("Need URI")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		creds[entry.URI] = entry
+	} else if r.Method == http.MethodDelete {
+		_, exists := creds[entry.URI]
+		if !exists {
+			http.Error(w, "Entry not found", 400)
+			return
+		}
+		delete(creds, entry.URI)
+	}
+
+	err = saveCredentialsLocked(creds)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(credentialsInfo(entry))
+}
@@ -0,0 +1,167 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestListCredentials(t *testing.T) {
+	CREDENTIALS_PATH = t.TempDir() + "/block_credentials.json"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Feed") != "dns" {
+			http.Error(w, "missing header", 400)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if r.Header.Get("Authorization") != "Bearer s3cret" && !(ok && user == "spr" && pass == "hunter2") {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		w.Write([]byte("0.0.0.0 feed.example.com\n"))
+	}))
+	defer srv.Close()
+
+	b := New()
+	r := httptest.NewRecorder()
+	router := http.HandlerFunc(b.modifyListCredentials)
+
+	entry := ListEntry{URI: srv.URL + "/feed", Headers: map[string]string{"X-Feed": "dns"}}
+
+	os.Remove("/tmp/credentials_test.db")
+	db := BoltOpen("/tmp/credentials_test.db")
+	defer db.Close()
+
+	if err := b.dbStagingDownload(db, entry, 0); err == nil {
+		t.Errorf("expected download without credentials to fail")
+	}
+
+	for _, creds := range []ListCredentials{
+		{URI: entry.URI, BearerToken: "s3cret"},
+		{URI: entry.URI, Username: "spr", Password: "hunter2"},
+	} {
+		payload, _ := json.Marshal(creds)
+		req, _ := http.NewRequest("PUT", "/blocklists/credentials", bytes.NewBuffer(payload))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		if err := b.dbStagingDownload(db, entry, 0); err != nil {
+			t.Errorf("expected download with credentials to succeed, got %v", err)
+		}
+	}
+
+	info, err := os.Stat(CREDENTIALS_PATH)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected credentials file with mode 0600, got %v %v", info, err)
+	}
+
+	req, _ := http.NewRequest("GET", "/blocklists/credentials", nil)
+	router.ServeHTTP(r, req)
+	if strings.Contains(r.Body.String(), "hunter2") || !strings.Contains(r.Body.String(), `"BasicAuth":true`) {
+		t.Errorf("unexpected credentials listing %s", r.Body.String())
+	}
+}
+
+func TestCredentialsStayOnListHost(t *testing.T) {
+	CREDENTIALS_PATH = t.TempDir() + "/block_credentials.json"
+
+	leaked := false
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			leaked = true
+		}
+		http.NotFound(w, r)
+	}))
+	defer other.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0.0.0.0 feed.example.com\n"))
+	}))
+	defer srv.Close()
+
+	Credmtx.Lock()
+	saveCredentialsLocked(map[string]ListCredentials{srv.URL + "/feed": {URI: srv.URL + "/feed", BearerToken: "s3cret"}})
+	Credmtx.Unlock()
+
+	os.Remove("/tmp/credentials_test.db")
+	db := BoltOpen("/tmp/credentials_test.db")
+	defer db.Close()
+
+	b := New()
+	b.dbStagingDownload(db, ListEntry{URI: srv.URL + "/feed", SHA256: other.URL + "/feed.sha256"}, 0)
+	if leaked {
+		t.Errorf("credentials were sent to another host")
+	}
+}
+
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return &http.Response{StatusCode: 404, Body: http.NoBody, Request: req}, nil
+}
+
+func TestCredentialsStayOnListScheme(t *testing.T) {
+	base := &recordingTransport{}
+	transport := &listTransport{
+		base:        base,
+		scheme:      "https",
+		host:        "lists.example.com",
+		credentials: ListCredentials{BearerToken: "s3cret"},
+	}
+
+	for _, uri := range []string{"https://lists.example.com/feed", "http://lists.example.com/feed"} {
+		req, _ := http.NewRequest("GET", uri, nil)
+		transport.RoundTrip(req)
+	}
+
+	if base.requests[0].Header.Get("Authorization") != "Bearer s3cret" {
+		t.Errorf("expected credentials for the list URI")
+	}
+	if base.requests[1].Header.Get("Authorization") != "" {
+		t.Errorf("credentials were sent over http")
+	}
+}
+
+func TestListProxy(t *testing.T) {
+	CREDENTIALS_PATH = t.TempDir() + "/block_credentials.json"
+
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("0.0.0.0 proxied.example.com\n"))
+	}))
+	defer proxy.Close()
+
+	os.Remove("/tmp/credentials_test.db")
+	db := BoltOpen("/tmp/credentials_test.db")
+	defer db.Close()
+
+	b := New()
+	b.config.Proxy = "http://127.0.0.1:1"
+
+	err := b.dbStagingDownload(db, ListEntry{URI: "http://lists.example.org/hosts", Proxy: proxy.URL}, 0)
+	if err != nil {
+		t.Fatalf("download through proxy failed: %v", err)
+	}
+	if proxied != "http://lists.example.org/hosts" {
+		t.Errorf("expected the list to be fetched through the proxy, got %q", proxied)
+	}
+
+	b.config.Proxy = proxy.URL
+	proxied = ""
+	err = b.dbStagingDownload(db, ListEntry{URI: "http://lists.example.org/other"}, 0)
+	if err != nil || proxied != "http://lists.example.org/other" {
+		t.Errorf("expected the configured proxy to be used, got %q %v", proxied, err)
+	}
+
+	if !listHas(db, 0, "proxied.example.com.") {
+		t.Errorf("missing proxied.example.com.")
+	}
+}
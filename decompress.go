@@ -0,0 +1,193 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// upper bound for a single list once decompressed, guards against
+// compression bombs.
+var gMaxDecompressedSize int64 = 512 * 1024 * 1024
+
+var ErrDecompressedTooLarge = errors.New("decompressed list exceeds size limit")
+
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionXz   = "xz"
+)
+
+var (
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicXz   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// sent with list requests. Setting it ourselves turns off the transparent
+// gzip handling of net/http, so decodeContentEncoding handles gzip as well.
+const listAcceptEncoding = "gzip, zstd"
+
+// listReader is a decompressed view of a list body
+type listReader struct {
+	io.Reader
+	closers []func()
+}
+
+func (l *listReader) Close() error {
+	for i := len(l.closers) - 1; i >= 0; i-- {
+		l.closers[i]()
+	}
+	return nil
+}
+
+func compressionFromName(name string) string {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "gzip", "x-gzip", "application/gzip", "application/x-gzip", ".gz":
+		return compressionGzip
+	case "zstd", "application/zstd", "application/x-zstd", ".zst", ".zstd":
+		return compressionZstd
+	case "xz", "application/x-xz", ".xz":
+		return compressionXz
+	}
+	return compressionNone
+}
+
+// listCompressionHint guesses the compression of the list file itself from
+// the Content-Type header, falling back to the extension of the URI.
+func listCompressionHint(resp *http.Response, uri string) string {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err == nil {
+		if c := compressionFromName(mediaType); c != compressionNone {
+			return c
+		}
+	}
+
+	p := uri
+	if u, err := url.Parse(uri); err == nil {
+		p = u.Path
+	}
+	return compressionFromName(path.Ext(p))
+}
+
+func sniffCompression(br *bufio.Reader) string {
+	head, _ := br.Peek(len(magicXz))
+	switch {
+	case bytes.HasPrefix(head, magicGzip):
+		return compressionGzip
+	case bytes.HasPrefix(head, magicZstd):
+		return compressionZstd
+	case bytes.HasPrefix(head, magicXz):
+		return compressionXz
+	}
+	return compressionNone
+}
+
+func newDecompressor(r io.Reader, compression string) (io.Reader, func(), error) {
+	switch compression {
+	case compressionGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case compressionZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	case compressionXz:
+		zr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() {}, nil
+	}
+	return r, func() {}, nil
+}
+
+// decodeContentEncoding undoes the transfer level Content-Encoding of a
+// response and returns the list file as it was published.
+func decodeContentEncoding(resp *http.Response) (*listReader, error) {
+	lr := &listReader{Reader: resp.Body}
+
+	encodings := strings.Split(resp.Header.Get("Content-Encoding"), ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+
+		compression := compressionFromName(encoding)
+		if compression == compressionNone {
+			lr.Close()
+			return nil, errors.New("unsupported content encoding " + encoding)
+		}
+
+		r, closer, err := newDecompressor(lr.Reader, compression)
+		if err != nil {
+			lr.Close()
+			return nil, err
+		}
+		lr.Reader = r
+		lr.closers = append(lr.closers, closer)
+	}
+
+	return lr, nil
+}
+
+// decompressList unpacks a gzip, zstd or xz compressed list file. The hint
+// comes from listCompressionHint, the magic bytes have the final say so a
+// mislabeled list still loads. The output is capped at gMaxDecompressedSize.
+func decompressList(r io.Reader, hint string) (*listReader, error) {
+	lr := &listReader{}
+
+	br := bufio.NewReader(r)
+	compression := sniffCompression(br)
+	if compression != hint && compression != compressionNone {
+		log.Debugf("List announced as %q is %s compressed", hint, compression)
+	}
+
+	dr, closer, err := newDecompressor(br, compression)
+	if err != nil {
+		return nil, err
+	}
+	lr.closers = append(lr.closers, closer)
+	lr.Reader = &cappedReader{r: dr, remaining: gMaxDecompressedSize}
+
+	return lr, nil
+}
+
+// cappedReader fails with ErrDecompressedTooLarge instead of silently
+// truncating once more than remaining bytes were read.
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.remaining < 0 {
+		return 0, ErrDecompressedTooLarge
+	}
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return n, ErrDecompressedTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,123 @@
+package block
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var compressedList = `
+127.0.0.1	gzip.example.com
+0.0.0.0 zstd.example.com
+xz.example.com
+`
+
+func compressList(t *testing.T, compression string, data []byte) []byte {
+	var buf bytes.Buffer
+	switch compression {
+	case compressionGzip:
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+	case compressionZstd:
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Close()
+	case compressionXz:
+		w, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Close()
+	default:
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressedDownload(t *testing.T) {
+	plain := []byte(compressedList)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hosts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(plain)
+	})
+	mux.HandleFunc("/hosts.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressList(t, compressionGzip, plain))
+	})
+	mux.HandleFunc("/hosts.zst", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressList(t, compressionZstd, plain))
+	})
+	mux.HandleFunc("/hosts.xz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressList(t, compressionXz, plain))
+	})
+	mux.HandleFunc("/typed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(compressList(t, compressionGzip, plain))
+	})
+	mux.HandleFunc("/encoded", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "zstd") {
+			t.Errorf("expected zstd in Accept-Encoding, got %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "zstd")
+		w.Write(compressList(t, compressionZstd, plain))
+	})
+	mux.HandleFunc("/double", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressList(t, compressionGzip, compressList(t, compressionXz, plain)))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, path := range []string{"/hosts", "/hosts.gz", "/hosts.zst", "/hosts.xz", "/typed", "/encoded", "/double"} {
+		os.Remove("/tmp/compressed_test.db")
+		db := BoltOpen("/tmp/compressed_test.db")
+
+		b := New()
+		err := b.dbStagingDownload(db, ListEntry{URI: srv.URL + path}, 0)
+		if err != nil {
+			t.Errorf("%s: download failed: %v", path, err)
+		}
+
+		for _, domain := range []string{"gzip.example.com.", "zstd.example.com.", "xz.example.com."} {
+			if !listHas(db, 0, domain) {
+				t.Errorf("%s: missing %s", path, domain)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestCompressionBomb(t *testing.T) {
+	saved := gMaxDecompressedSize
+	gMaxDecompressedSize = 1024
+	defer func() { gMaxDecompressedSize = saved }()
+
+	bomb := compressList(t, compressionGzip, bytes.Repeat([]byte("a.example.com\n"), 1024*1024))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bomb)
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/compressed_test.db")
+	db := BoltOpen("/tmp/compressed_test.db")
+	defer db.Close()
+
+	b := New()
+	err := b.dbStagingDownload(db, ListEntry{URI: srv.URL + "/bomb.gz"}, 0)
+	if err != ErrDecompressedTooLarge {
+		t.Errorf("expected ErrDecompressedTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package block
+
+import "errors"
+
+// diskAvailable is not known on this platform
+func diskAvailable(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
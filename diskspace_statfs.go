@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package block
+
+import "syscall"
+
+// diskAvailable returns the bytes available to the plugin on the file
+// system of dir
+func diskAvailable(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
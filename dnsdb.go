@@ -1,6 +1,8 @@
 package block
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -37,20 +39,119 @@ func (item *BucketItem) EncodeKey() []byte {
 	return []byte(item.Key)
 }
 
+// values are stored as a version byte, a flags byte, the number of list
+// ids and the ids as varints. JSON values from before start with '{' and
+// are still read.
+const (
+	gValueVersion  = 1
+	gValueDisabled = 1 << 0
+)
+
 func (item *BucketItem) EncodeValue() ([]byte, error) {
+	buf := make([]byte, 2, 3+len(item.Value.List_ids)*2)
+	buf[0] = gValueVersion
+	if item.Value.Disabled {
+		buf[1] |= gValueDisabled
+	}
 
-	buf, err := json.Marshal(item.Value)
-	if err != nil {
-		return nil, ErrBucketItemEncode
+	buf = binary.AppendUvarint(buf, uint64(len(item.Value.List_ids)))
+	for _, list_id := range item.Value.List_ids {
+		buf = binary.AppendVarint(buf, int64(list_id))
 	}
 	return buf, nil
 }
 
 func (item *BucketItem) DecodeValue(rawValue []byte) error {
-	if err := json.Unmarshal(rawValue, &item.Value); err != nil {
-		return err
+	if len(rawValue) > 0 && rawValue[0] == '{' {
+		if err := json.Unmarshal(rawValue, &item.Value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if len(rawValue) < 3 || rawValue[0] != gValueVersion {
+		return ErrBucketItemDecode
+	}
+
+	value := DomainValue{Disabled: rawValue[1]&gValueDisabled != 0}
+	count, n := binary.Uvarint(rawValue[2:])
+	if n <= 0 || count > uint64(len(rawValue)) {
+		return ErrBucketItemDecode
 	}
+	rest := rawValue[2+n:]
 
+	value.List_ids = make([]int, count)
+	for i := range value.List_ids {
+		list_id, n := binary.Varint(rest)
+		if n <= 0 {
+			return ErrBucketItemDecode
+		}
+		value.List_ids[i] = int(list_id)
+		rest = rest[n:]
+	}
+
+	item.Value = value
+	return nil
+}
+
+// migrateValueEncoding rewrites JSON values in the compact encoding, in
+// chunks of gListChunk
+func migrateValueEncoding(db *bolt.DB) error {
+	migrated := 0
+	var after []byte
+	for done := false; !done; {
+		items := []BucketItem{}
+		err := db.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(gDomainBucket))
+			if bucket == nil {
+				done = true
+				return nil
+			}
+			c := bucket.Cursor()
+			k, v := seekAfter(c, after)
+			for ; k != nil && len(items) < gListChunk; k, v = c.Next() {
+				after = bytes.Clone(k)
+				if len(v) == 0 || v[0] != '{' {
+					continue
+				}
+				item := BucketItem{Key: string(k)}
+				if item.DecodeValue(v) == nil {
+					items = append(items, item)
+				}
+			}
+			done = k == nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(items) == 0 {
+			continue
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(gDomainBucket))
+			for _, item := range items {
+				itemValue, err := item.EncodeValue()
+				if err == nil {
+					err = bucket.Put(item.EncodeKey(), itemValue)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		migrated += len(items)
+	}
+
+	if migrated > 0 {
+		log.Infof("Migrated %d domains to the compact value encoding", migrated)
+	}
 	return nil
 }
 
@@ -87,9 +188,6 @@ func putItem(db *bolt.DB, bucket string, item BucketItem) error {
 		return err
 	})
 
-	if err == nil {
-		db.Sync()
-	}
 	return err
 }
 
@@ -99,41 +197,49 @@ func cleanBucket(db *bolt.DB, bucket string) error {
 		return tx.DeleteBucket([]byte(bucket))
 	})
 
-	if err == nil {
-		db.Sync()
-	}
-
 	return err
 }
 
+// compactDb rewrites the db into a new file and swaps it in. List updates
+// wait for it, lookups keep using the old db until the new one is published.
 func (b *Block) compactDb() error {
+	Dmtx.Lock()
+	defer Dmtx.Unlock()
 
-	dst, err := bolt.Open(b.DbPath+".tmp", 0664, nil)
-	defer dst.Close()
+	tmp := b.DbPath + ".tmp"
+	os.Remove(tmp)
 
+	dst, err := bolt.Open(tmp, 0664, nil)
 	if err != nil {
 		return err
 	}
 
-	err = bolt.Compact(dst, b.Db, 0)
+	err = bolt.Compact(dst, b.db(), 0)
+	dst.Close()
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
 
-	err = os.Rename(b.DbPath+".tmp", b.DbPath)
+	return b.replaceDBLocked(tmp)
+}
+
+// replaceDBLocked swaps the db file tmp in for the live db and publishes
+// it, with Dmtx held. Lookups in flight finish on the old db.
+func (b *Block) replaceDBLocked(tmp string) error {
+	err := swapDB(b.DbPath, tmp)
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
 
-	//close and re-open db
-	b.Db.Close()
-
-	options := &bolt.Options{Timeout: 1 * time.Second}
-	db, err := bolt.Open(b.DbPath, 0664, options)
-	if err != nil {
-		log.Fatal("Failed to open", b.DbPath, err)
+	db, rebuilt := openDB(b.DbPath)
+	b.setRebuilding(rebuilt)
+	b.publish(withStore(newDBRef(db), b.configuredStoreKind()))
+	if rebuilt {
+		b.rebuildFilterLocked()
+		b.download()
 	}
-	b.Db = db
 	return nil
 }
 
@@ -181,50 +287,29 @@ func getItem(db *bolt.DB, bucket string, key string) (error, BucketItem) {
 func BoltOpen(filename string) *bolt.DB {
 	options := &bolt.Options{Timeout: 1 * time.Second, NoSync: true}
 
-	db, err := bolt.Open(filename, 0664, options)
+	db, err := boltOpen(filename, options)
 	if err != nil {
 		log.Fatal("Failed to open ", filename, err)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(gDomainBucket))
-		if err != nil {
-			log.Fatal("could not create bucket", err)
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		log.Fatal("Failed to make bucket", err)
-	} else {
-		db.Sync()
-	}
-
 	return db
 }
 
+// storeBatch adds list_id to domains[:idx] in db
 func storeBatch(db *bolt.DB, domains []string, idx int, list_id int) error {
 	err := db.Batch(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(gDomainBucket))
+		list, err := createListBucket(tx, list_id)
+		if err != nil {
+			return err
+		}
 
-		i := 0
-		for i < idx {
-			domain := domains[i]
-			i++
-
-			value := DomainValue{[]int{list_id}, false}
-			//see if bucket already has it
-			err, item := getItemBucket(bucket, domain)
-			if err != nil {
-				//add this  current list_id to it.
-				value.List_ids = append(item.Value.List_ids, list_id)
-			}
-
-			item = BucketItem{domain, value}
-			itemValue, err := item.EncodeValue()
+		for _, domain := range domains[:idx] {
+			//lists are downloaded in parallel, addListID keeps the ids sorted
+			//so the result does not depend on which list finished first.
+			err = addListID(bucket, []byte(domain), list_id)
 			if err == nil {
-				err = bucket.Put(item.EncodeKey(), itemValue)
+				err = list.Put([]byte(domain), []byte{})
 			}
 			if err != nil {
 				fmt.Println("putItem failed", domain)
@@ -233,32 +318,15 @@ func storeBatch(db *bolt.DB, domains []string, idx int, list_id int) error {
 		}
 		return nil
 	})
-	if err == nil {
-		db.Sync()
-	}
 	return err
 }
 
-func (b *Block) transferStagingDB() error {
-	b.Db.Close()
-
-	err := os.Rename(b.DbPath+"-staging", b.DbPath)
-	if err != nil {
-		return err
-	}
-
-	b.Db = BoltOpen(b.DbPath)
-
-	gMetrics.BlockedDomains = getCount(b.Db, gDomainBucket)
-
-	return nil
-}
-
-func (b *Block) UpdateDomains(update map[string]DomainValue) error {
-	err := b.Db.Update(func(tx *bolt.Tx) error {
+// updateDomains stores update in db, replacing the values of domains it has
+func updateDomains(db *bolt.DB, update map[string]DomainValue) error {
+	err := db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(gDomainBucket))
 
-		for entry, v := range b.update {
+		for entry, v := range update {
 			if entry == "" {
 				continue
 			}
@@ -270,16 +338,38 @@ func (b *Block) UpdateDomains(update map[string]DomainValue) error {
 			if err != nil {
 				return err
 			}
+			for _, list_id := range v.List_ids {
+				list, err := createListBucket(tx, list_id)
+				if err == nil {
+					err = list.Put(item.EncodeKey(), []byte{})
+				}
+				if err != nil {
+					return err
+				}
+			}
 		}
 		return nil
 	})
 
+	return err
+}
+
+func (b *Block) UpdateDomains(update map[string]DomainValue) error {
+	if f := b.filter.Load(); f != nil {
+		for domain := range update {
+			f.add([]byte(domain))
+		}
+	}
+
+	Dmtx.RLock()
+	defer Dmtx.RUnlock()
+
+	err := b.domainStore().Update(update)
 	if err != nil {
 		return err
 	}
-	b.Db.Sync()
 
-	gMetrics.BlockedDomains = getCount(b.Db, gDomainBucket)
+	gMetrics.BlockedDomains.Store(getCount(b.db(), gDomainBucket))
 
 	return nil
 }
@@ -0,0 +1,144 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestValueEncoding(t *testing.T) {
+	values := []DomainValue{
+		{List_ids: []int{}},
+		{List_ids: []int{0}},
+		{List_ids: []int{-1, 3, 300, 70000}, Disabled: true},
+	}
+
+	for _, value := range values {
+		item := BucketItem{Value: value}
+		encoded, err := item.EncodeValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := BucketItem{}
+		if err := decoded.DecodeValue(encoded); err != nil {
+			t.Fatalf("%v: %v", value, err)
+		}
+		if !slices.Equal(decoded.Value.List_ids, value.List_ids) || decoded.Value.Disabled != value.Disabled {
+			t.Errorf("expected %v, got %v", value, decoded.Value)
+		}
+
+		legacy, _ := json.Marshal(value)
+		decoded = BucketItem{}
+		if err := decoded.DecodeValue(legacy); err != nil || !slices.Equal(decoded.Value.List_ids, value.List_ids) {
+			t.Errorf("failed to read JSON value %s: %v", legacy, err)
+		}
+	}
+
+	for _, bad := range [][]byte{{}, {gValueVersion, 0}, {gValueVersion, 0, 5, 1}, {9, 0, 0}} {
+		if err := (&BucketItem{}).DecodeValue(bad); err == nil {
+			t.Errorf("expected %v to fail decoding", bad)
+		}
+	}
+}
+
+func putJSONValues(db *bolt.DB, n int) {
+	db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(gDomainBucket))
+		for i := 0; i < n; i++ {
+			value, _ := json.Marshal(DomainValue{List_ids: []int{i % 3, 4}})
+			bucket.Put([]byte(fmt.Sprintf("host%d.example.com.", i)), value)
+		}
+		return nil
+	})
+}
+
+func TestMigrateValueEncoding(t *testing.T) {
+	chunk := gListChunk
+	gListChunk = 7
+	defer func() { gListChunk = chunk }()
+
+	os.Remove("/tmp/encoding_test.db")
+	db := BoltOpen("/tmp/encoding_test.db")
+	putJSONValues(db, 50)
+	db.Close()
+
+	b := New()
+	b.setupDB("/tmp/encoding_test.db")
+	defer b.closeDB()
+
+	b.db().View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(gDomainBucket)).ForEach(func(k, v []byte) error {
+			if v[0] != gValueVersion {
+				t.Errorf("%s was not migrated: %s", k, v)
+			}
+			return nil
+		})
+	})
+
+	value, found := b.getDomain("host7.example.com.")
+	if !found || !slices.Equal(value.List_ids, []int{1, 4}) {
+		t.Errorf("unexpected value after migration %v", value)
+	}
+	if !listHas(b.db(), 4, "host7.example.com.") {
+		t.Errorf("expected list buckets to be built from the JSON values")
+	}
+}
+
+// BenchmarkValueEncoding compares decoding and database size of JSON and
+// the compact encoding. With 100k domains in two lists each the database
+// shrinks from 15.5MB to 8.9MB and a value takes 5 bytes instead of 35,
+// decoding takes about 170ns instead of 1600ns.
+func BenchmarkValueEncoding(b *testing.B) {
+	n := 100000
+	value := DomainValue{List_ids: []int{1, 4}}
+
+	legacy, _ := json.Marshal(value)
+	item := BucketItem{Value: value}
+	compact, _ := item.EncodeValue()
+
+	//sorted, bolt is slow to insert many unsorted keys in one transaction
+	keys := []string{}
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("host%d.domain%d.com.", i%7, i))
+	}
+	slices.Sort(keys)
+
+	for _, bench := range []struct {
+		name    string
+		encoded []byte
+	}{{"json", legacy}, {"binary", compact}} {
+		b.Run(bench.name, func(b *testing.B) {
+			path := "/tmp/encoding_bench_" + bench.name + ".db"
+			os.Remove(path)
+			db := BoltOpen(path)
+			size := int64(0)
+			db.Update(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket([]byte(gDomainBucket))
+				for _, key := range keys {
+					bucket.Put([]byte(key), bench.encoded)
+				}
+				return nil
+			})
+			db.View(func(tx *bolt.Tx) error {
+				size = tx.Size()
+				return nil
+			})
+			db.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				decoded := BucketItem{}
+				decoded.DecodeValue(bench.encoded)
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(size)/1e6, "MB/db")
+			b.ReportMetric(float64(len(bench.encoded)), "B/value")
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	"github.com/coredns/coredns/request"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// messages queued for the dnstap output, a full queue drops messages rather
+// than holding up queries
+var gDnstapQueue = 4096
+
+var gDnstapIdentity = []byte("coredns-block")
+
+// writes to the socket time out after gDnstapTimeout, a socket that can't
+// be reached is tried again after gDnstapRetryInterval and messages are
+// dropped in between
+var gDnstapTimeout = time.Second
+var gDnstapRetryInterval = 5 * time.Second
+
+// close gives up on the queued messages after this long
+var gDnstapCloseTimeout = 5 * time.Second
+
+// dnstapOutput writes frames to a unix socket, reconnecting as needed, or
+// to a file. The connection is owned by run, so no write blocks past
+// gDnstapTimeout and closing always releases it.
+type dnstapOutput struct {
+	target  string
+	socket  string        //path of the socket, empty for a file
+	writer  dnstap.Writer //nil while not connected
+	closer  io.Closer     //the connection or file under writer
+	retry   time.Time     //no connection attempt before
+	frames  chan []byte   //never closed, queries may still be writing
+	stop    chan struct{} //closed to write the queued frames and close the output
+	abort   chan struct{} //closed to drop the frames not written yet
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// openDnstap opens target, unix:///path for a socket or else a file path
+func openDnstap(target string) (*dnstapOutput, error) {
+	t := &dnstapOutput{
+		target: target,
+		frames: make(chan []byte, gDnstapQueue),
+		stop:   make(chan struct{}),
+		abort:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if path, ok := strings.CutPrefix(target, "unix://"); ok {
+		t.socket = path
+	} else {
+		//a file holds one frame stream, the file of an earlier open is
+		//moved aside rather than truncated
+		if info, err := os.Stat(target); err == nil && info.Size() > 0 {
+			err = os.Rename(target, fmt.Sprintf("%s.%d", target, info.ModTime().Unix()))
+			if err != nil {
+				return nil, err
+			}
+		}
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		writer, err := dnstap.NewWriter(file, nil)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		t.writer, t.closer = writer, file
+	}
+
+	go t.run()
+	return t, nil
+}
+
+// connect opens the socket unless it is open, at most once every
+// gDnstapRetryInterval
+func (t *dnstapOutput) connect() bool {
+	if t.writer != nil {
+		return true
+	}
+	if t.socket == "" || time.Now().Before(t.retry) {
+		return false
+	}
+	t.retry = time.Now().Add(gDnstapRetryInterval)
+
+	conn, err := net.DialTimeout("unix", t.socket, gDnstapTimeout)
+	if err != nil {
+		log.Warningf("Failed to connect to dnstap socket %q: %s", t.socket, err)
+		return false
+	}
+	writer, err := dnstap.NewWriter(conn, &dnstap.WriterOptions{Bidirectional: true, Timeout: gDnstapTimeout})
+	if err != nil {
+		log.Warningf("Failed to start dnstap stream on %q: %s", t.socket, err)
+		conn.Close()
+		return false
+	}
+	t.writer, t.closer = writer, conn
+	return true
+}
+
+// disconnect ends the stream and closes the connection or file
+func (t *dnstapOutput) disconnect() {
+	if t.writer == nil {
+		return
+	}
+	t.writer.Close()
+	t.closer.Close()
+	t.writer, t.closer = nil, nil
+}
+
+// writeFrame writes frame, flushing once the queue is empty
+func (t *dnstapOutput) writeFrame(frame []byte) {
+	if !t.connect() {
+		t.dropped.Add(1)
+		return
+	}
+
+	_, err := t.writer.WriteFrame(frame)
+	if flusher, ok := t.writer.(interface{ Flush() error }); ok && err == nil && len(t.frames) == 0 {
+		err = flusher.Flush()
+	}
+	if err != nil {
+		log.Warningf("Failed to write dnstap message to %q: %s", t.target, err)
+		t.disconnect()
+		t.dropped.Add(1)
+	}
+}
+
+// run writes the queued frames until stopped, then the frames still
+// queued unless aborted, and closes the output
+func (t *dnstapOutput) run() {
+	defer close(t.done)
+	defer t.disconnect()
+
+	for {
+		select {
+		case frame := <-t.frames:
+			t.writeFrame(frame)
+		case <-t.stop:
+			for len(t.frames) > 0 {
+				select {
+				case <-t.abort:
+					return
+				default:
+				}
+				t.writeFrame(<-t.frames)
+			}
+			return
+		}
+	}
+}
+
+// write queues payload without blocking. Once the output is closed
+// messages are dropped.
+func (t *dnstapOutput) write(payload *dnstap.Dnstap) {
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+
+	frame, err := proto.Marshal(payload)
+	if err != nil {
+		log.Warningf("Failed to encode dnstap message: %s", err)
+		return
+	}
+	select {
+	case t.frames <- frame:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// close writes the queued messages and closes the output. Past
+// gDnstapCloseTimeout the rest is dropped, the output is closed once the
+// write in progress times out.
+func (t *dnstapOutput) close() {
+	close(t.stop)
+	select {
+	case <-t.done:
+	case <-time.After(gDnstapCloseTimeout):
+		log.Warningf("Gave up writing dnstap messages to %q", t.target)
+		close(t.abort)
+	}
+}
+
+// setupDnstap opens or closes the dnstap output as configured
+func (b *Block) setupDnstap() {
+	if old := b.dnstap.Load(); old != nil && old.target == b.config.Dnstap {
+		return
+	}
+	if old := b.dnstap.Swap(nil); old != nil {
+		old.close()
+	}
+	if b.config.Dnstap == "" {
+		return
+	}
+
+	t, err := openDnstap(b.config.Dnstap)
+	if err != nil {
+		log.Warningf("Failed to open dnstap output %q: %s", b.config.Dnstap, err)
+		return
+	}
+	b.dnstap.Store(t)
+}
+
+// tapResponse emits a CLIENT_RESPONSE for a response the plugin
+// synthesized, with the decision as the extra field
+func (b *Block) tapResponse(state request.Request, start time.Time, resp *dns.Msg, details EventDetails) {
+	t := b.dnstap.Load()
+	if t == nil {
+		return
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		log.Warningf("Failed to pack dnstap response: %s", err)
+		return
+	}
+	extra, err := json.Marshal(details)
+	if err != nil {
+		return
+	}
+
+	m := &dnstap.Message{ResponseMessage: packed}
+	msg.SetType(m, dnstap.Message_CLIENT_RESPONSE)
+	msg.SetQueryAddress(m, state.W.RemoteAddr())
+	msg.SetQueryTime(m, start)
+	msg.SetResponseTime(m, time.Now())
+
+	typ := dnstap.Dnstap_MESSAGE
+	t.write(&dnstap.Dnstap{
+		Type:     &typ,
+		Identity: gDnstapIdentity,
+		Extra:    extra,
+		Message:  m,
+	})
+}
@@ -0,0 +1,154 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDnstap(t *testing.T) {
+	//a local reader on a unix socket
+	sock := t.TempDir() + "/dnstap.sock"
+	input, err := dnstap.NewFrameStreamSockInputFromPath(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan []byte, 16)
+	go input.ReadInto(frames)
+
+	b, _ := newTestBlock(t, "0.0.0.0 ads.example.com\n", []OverrideList{{Name: "main", Enabled: true,
+		PermitDomains: []DomainOverride{{Type: "Permit", Domain: "local.example.org.", ResultIP: "192.168.2.10", ClientIP: "*"}},
+	}})
+	b.config.Dnstap = "unix://" + sock
+	b.setupDnstap()
+
+	//forwarded answers are left to the dnstap plugin
+	for _, name := range []string{"www.ads.example.com.", "good.example.org.", "local.example.org.", "private.example.org."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		b.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	}
+	b.config.Dnstap = ""
+	b.setupDnstap()
+
+	expected := []struct {
+		name   string
+		action string
+		rcode  int
+	}{
+		{"www.ads.example.com.", "blocked", dns.RcodeNameError},
+		{"local.example.org.", "override", dns.RcodeSuccess},
+		{"private.example.org.", "rebinding", dns.RcodeNameError},
+	}
+	for _, want := range expected {
+		var frame []byte
+		select {
+		case frame = <-frames:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no dnstap message for %s", want.name)
+		}
+
+		payload := &dnstap.Dnstap{}
+		if err := proto.Unmarshal(frame, payload); err != nil {
+			t.Fatal(err)
+		}
+		m := payload.GetMessage()
+		if m.GetType() != dnstap.Message_CLIENT_RESPONSE || m.QueryAddress == nil || m.ResponseTimeSec == nil {
+			t.Errorf("unexpected message %v", m)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(m.GetResponseMessage()); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Question[0].Name != want.name || resp.Rcode != want.rcode {
+			t.Errorf("expected %s with rcode %d, got %v", want.name, want.rcode, resp)
+		}
+
+		details := EventDetails{}
+		if err := json.Unmarshal(payload.GetExtra(), &details); err != nil {
+			t.Fatal(err)
+		}
+		if details.Action != want.action || details.Version != gEventVersion {
+			t.Errorf("expected the %s decision in the extra field, got %+v", want.action, details)
+		}
+	}
+
+	select {
+	case frame := <-frames:
+		t.Errorf("unexpected dnstap message %q", frame)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDnstapDrops(t *testing.T) {
+	savedQueue, savedTimeout := gDnstapQueue, gDnstapCloseTimeout
+	defer func() { gDnstapQueue, gDnstapCloseTimeout = savedQueue, savedTimeout }()
+	gDnstapQueue = 4
+	gDnstapCloseTimeout = 100 * time.Millisecond
+
+	//without a reader writes keep failing and the queue fills up
+	out, err := openDnstap("unix://" + t.TempDir() + "/missing.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	typ := dnstap.Dnstap_MESSAGE
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		out.write(&dnstap.Dnstap{Type: &typ, Identity: gDnstapIdentity})
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected writes not to block, took %s", time.Since(start))
+	}
+	if out.dropped.Load() == 0 {
+		t.Errorf("expected messages past the queue to be dropped")
+	}
+
+	//close gives up on the queue, the output is still closed and later
+	//writes are dropped
+	out.close()
+	out.write(&dnstap.Dnstap{Type: &typ, Identity: gDnstapIdentity})
+	select {
+	case <-out.done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the output to be closed")
+	}
+}
+
+func TestDnstapFile(t *testing.T) {
+	path := t.TempDir() + "/dnstap.fstrm"
+	typ := dnstap.Dnstap_MESSAGE
+	for i := 0; i < 2; i++ {
+		out, err := openDnstap(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.write(&dnstap.Dnstap{Type: &typ, Identity: gDnstapIdentity})
+		out.close()
+		<-out.done
+	}
+
+	//the stream of the first open is kept next to the one of the second
+	files, _ := filepath.Glob(path + "*")
+	if len(files) != 2 {
+		t.Fatalf("expected the earlier file to be kept, got %v", files)
+	}
+	for _, file := range files {
+		input, err := dnstap.NewFrameStreamInputFromFilename(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames := make(chan []byte, 4)
+		input.ReadInto(frames)
+		if len(frames) != 1 {
+			t.Errorf("expected one message in %s, got %d", file, len(frames))
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
+	bolt "go.etcd.io/bbolt"
+)
+
+// page sizes of /domains, and the keys one request walks at most before it
+// returns a partial page with a cursor to go on from
+var gDomainsPageLimit = 100
+var gDomainsMaxLimit = 1000
+var gDomainsScanLimit = 100000
+
+// DomainQuery selects domains of the db. Prefix is matched on the stored
+// name, so "ads." finds ads.example.com. and not www.ads.example.com.
+type DomainQuery struct {
+	Cursor   string //the last domain of the previous page
+	Limit    int
+	Prefix   string
+	Suffix   string
+	Contains string
+	ListID   *int
+	Category string
+}
+
+type DomainEntry struct {
+	Domain     string
+	ListIDs    []int
+	Categories []string
+	Disabled   bool `json:",omitempty"`
+}
+
+type DomainPage struct {
+	Domains []DomainEntry
+	Scanned int    //keys walked for this page
+	Next    string `json:",omitempty"` //cursor of the next page, empty at the end
+}
+
+// DomainList is a list a domain is stored for
+type DomainList struct {
+	ID       int
+	URI      string `json:",omitempty"`
+	Category string `json:",omitempty"`
+	Tags     []string
+	State    string //enabled, disabled, deleted or not configured
+}
+
+type DomainDetail struct {
+	DomainEntry
+	Lists []DomainList
+}
+
+// listCategoriesLocked returns the category of every configured list by
+// id, with BLmtx held
+func (b *Block) listCategoriesLocked() map[int]string {
+	listCategories := map[int]string{}
+	for _, entry := range b.config.BlockLists {
+		listCategories[entry.ID] = entry.Category
+	}
+	return listCategories
+}
+
+// categoriesOf returns the categories of list_ids
+func categoriesOf(listCategories map[int]string, list_ids []int) []string {
+	categories := []string{}
+	for _, list_id := range list_ids {
+		category := listCategories[list_id]
+		if category != "" && !slices.Contains(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
+// queryDomains walks the domains bucket, or the bucket of q.ListID, from
+// after q.Cursor and returns the domains matching q
+func (b *Block) queryDomains(db *bolt.DB, q DomainQuery) (DomainPage, error) {
+	page := DomainPage{Domains: []DomainEntry{}}
+
+	//copy the categories of the lists, the walk runs without BLmtx
+	BLmtx.RLock()
+	listCategories := b.listCategoriesLocked()
+	BLmtx.RUnlock()
+
+	//lists of the category, a domain has to be on one of them
+	var categoryIDs []int
+	if q.Category != "" {
+		categoryIDs = []int{}
+		for list_id, category := range listCategories {
+			if category == q.Category {
+				categoryIDs = append(categoryIDs, list_id)
+			}
+		}
+	}
+
+	prefix := []byte(q.Prefix)
+	err := db.View(func(tx *bolt.Tx) error {
+		domains := tx.Bucket([]byte(gDomainBucket))
+		source := domains
+		if q.ListID != nil {
+			source = listBucket(tx, *q.ListID)
+			if source == nil {
+				return nil
+			}
+		}
+
+		c := source.Cursor()
+		var k []byte
+		if q.Cursor != "" {
+			k, _ = seekAfter(c, []byte(q.Cursor))
+		} else if len(prefix) > 0 {
+			k, _ = c.Seek(prefix)
+		} else {
+			k, _ = c.First()
+		}
+
+		last := []byte{}
+		for ; k != nil; k, _ = c.Next() {
+			if len(prefix) > 0 && !bytes.HasPrefix(k, prefix) {
+				if bytes.Compare(k, prefix) > 0 {
+					//sorted, no more keys with the prefix
+					return nil
+				}
+				continue
+			}
+			if page.Scanned == gDomainsScanLimit || len(page.Domains) == q.Limit {
+				page.Next = string(last)
+				return nil
+			}
+			page.Scanned++
+			last = append(last[:0], k...)
+
+			name := string(k)
+			if q.Suffix != "" && !strings.HasSuffix(name, q.Suffix) {
+				continue
+			}
+			if q.Contains != "" && !strings.Contains(name, q.Contains) {
+				continue
+			}
+
+			item := BucketItem{}
+			if err := item.DecodeValue(domains.Get(k)); err != nil {
+				continue
+			}
+			if categoryIDs != nil && !slices.ContainsFunc(item.Value.List_ids, func(id int) bool { return slices.Contains(categoryIDs, id) }) {
+				continue
+			}
+
+			page.Domains = append(page.Domains, DomainEntry{
+				Domain:     name,
+				ListIDs:    item.Value.List_ids,
+				Categories: categoriesOf(listCategories, item.Value.List_ids),
+				Disabled:   item.Value.Disabled,
+			})
+		}
+		return nil
+	})
+
+	return page, err
+}
+
+// domainDetail returns the stored value of name and the state of the
+// lists it is on
+func (b *Block) domainDetail(db *bolt.DB, name string) (DomainDetail, bool) {
+	err, item := getItem(db, gDomainBucket, name)
+	if err != nil {
+		return DomainDetail{}, false
+	}
+
+	BLmtx.RLock()
+	defer BLmtx.RUnlock()
+
+	detail := DomainDetail{
+		DomainEntry: DomainEntry{
+			Domain:     name,
+			ListIDs:    item.Value.List_ids,
+			Categories: categoriesOf(b.listCategoriesLocked(), item.Value.List_ids),
+			Disabled:   item.Value.Disabled,
+		},
+		Lists: []DomainList{},
+	}
+
+	for _, list_id := range item.Value.List_ids {
+		list := DomainList{ID: list_id, Tags: []string{}, State: "not configured"}
+		if entry, exists := b.listByIDLocked(list_id); exists {
+			list.URI = entry.URI
+			list.Category = entry.Category
+			if entry.Tags != nil {
+				list.Tags = entry.Tags
+			}
+			list.State = "disabled"
+			if entry.Enabled {
+				list.State = "enabled"
+			}
+		} else if list_id >= 0 && list_id < b.config.NextListID {
+			list.State = "deleted"
+		}
+		detail.Lists = append(detail.Lists, list)
+	}
+
+	return detail, true
+}
+
+func (b *Block) listDomains(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := DomainQuery{
+		Cursor:   params.Get("cursor"),
+		Limit:    gDomainsPageLimit,
+		Prefix:   strings.ToLower(params.Get("prefix")),
+		Suffix:   strings.ToLower(params.Get("suffix")),
+		Contains: strings.ToLower(params.Get("contains")),
+		Category: params.Get("category"),
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		i, err := strconv.Atoi(limit)
+		if err != nil || i <= 0 {
+			http.Error(w, "invalid limit", 400)
+			return
+		}
+		q.Limit = min(i, gDomainsMaxLimit)
+	}
+
+	if list_id := params.Get("list_id"); list_id != "" {
+		i, err := strconv.Atoi(list_id)
+		if err != nil {
+			http.Error(w, "invalid list_id", 400)
+			return
+		}
+		q.ListID = &i
+	}
+
+	h := b.acquire()
+	if h == nil {
+		http.Error(w, "database not ready", 400)
+		return
+	}
+	page, err := b.queryDomains(h.db, q)
+	h.release()
+
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func (b *Block) showDomain(w http.ResponseWriter, r *http.Request) {
+	name := dns.Fqdn(strings.ToLower(mux.Vars(r)["domain"]))
+
+	h := b.acquire()
+	if h == nil {
+		http.Error(w, "database not ready", 400)
+		return
+	}
+	detail, found := b.domainDetail(h.db, name)
+	h.release()
+
+	if !found {
+		http.Error(w, "domain not found", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
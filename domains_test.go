@@ -0,0 +1,134 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func getDomainPage(t *testing.T, b *Block, query url.Values) DomainPage {
+	rr := httptest.NewRecorder()
+	b.listDomains(rr, httptest.NewRequest("GET", "/domains?"+query.Encode(), nil))
+	page := DomainPage{}
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatalf("%s: unexpected response %d: %v", query.Encode(), rr.Code, err)
+	}
+	return page
+}
+
+// allDomains follows the cursor through every page of query
+func allDomains(t *testing.T, b *Block, query url.Values) []string {
+	domains := []string{}
+	for pages := 0; pages < 100; pages++ {
+		page := getDomainPage(t, b, query)
+		for _, entry := range page.Domains {
+			domains = append(domains, entry.Domain)
+		}
+		if page.Next == "" {
+			return domains
+		}
+		query.Set("cursor", page.Next)
+	}
+	t.Fatalf("%s: cursor does not end", query.Encode())
+	return nil
+}
+
+func TestDomainsAPI(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 20; i++ {
+			fmt.Fprintf(w, "0.0.0.0 host%d.%s.example.com\n", i, r.URL.Path[1:])
+		}
+		fmt.Fprintf(w, "0.0.0.0 shared.example.net\n")
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/domains_test.db")
+	b := New()
+	b.setupDB("/tmp/domains_test.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{
+		{URI: srv.URL + "/ads", Enabled: true, Category: "ads"},
+		{URI: srv.URL + "/malware", Enabled: false, Category: "security", Tags: []string{"kids"}},
+	}
+	b.downloadLists(nil)
+	b.config.BlockLists[1].Enabled = true
+	b.downloadList(srv.URL + "/malware")
+	b.config.BlockLists[1].Enabled = false
+
+	domains := allDomains(t, b, url.Values{"limit": {"7"}})
+	if len(domains) != 41 || !slices.IsSorted(domains) || len(slices.Compact(slices.Clone(domains))) != 41 {
+		t.Errorf("expected 41 sorted domains over the pages, got %d", len(domains))
+	}
+
+	//a small scan budget returns partial pages, the cursor carries on
+	scanLimit := gDomainsScanLimit
+	gDomainsScanLimit = 5
+	if got := allDomains(t, b, url.Values{"suffix": {".malware.example.com."}}); len(got) != 20 {
+		t.Errorf("expected 20 domains with partial pages, got %d", len(got))
+	}
+	gDomainsScanLimit = scanLimit
+
+	for _, test := range []struct {
+		query url.Values
+		count int
+	}{
+		{url.Values{"prefix": {"host1"}}, 22},
+		{url.Values{"prefix": {"shared."}}, 1},
+		{url.Values{"prefix": {"zzz"}}, 0},
+		{url.Values{"suffix": {".net."}}, 1},
+		{url.Values{"contains": {"ads"}}, 20},
+		{url.Values{"list_id": {"1"}}, 21},
+		{url.Values{"list_id": {"7"}}, 0},
+		{url.Values{"category": {"security"}}, 21},
+		{url.Values{"category": {"ads"}, "prefix": {"host3."}}, 1},
+	} {
+		if got := allDomains(t, b, test.query); len(got) != test.count {
+			t.Errorf("%s: expected %d domains, got %d", test.query.Encode(), test.count, len(got))
+		}
+	}
+
+	page := getDomainPage(t, b, url.Values{"prefix": {"shared."}})
+	if len(page.Domains) != 1 || !slices.Equal(page.Domains[0].ListIDs, []int{0, 1}) || !slices.Equal(page.Domains[0].Categories, []string{"ads", "security"}) {
+		t.Errorf("unexpected entry %+v", page.Domains)
+	}
+
+	rr := httptest.NewRecorder()
+	b.listDomains(rr, httptest.NewRequest("GET", "/domains?limit=x", nil))
+	if rr.Code != 400 {
+		t.Errorf("expected a bad limit to fail, got %d", rr.Code)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/domains/{domain}", b.showDomain)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/domains/Shared.example.net", nil))
+	detail := DomainDetail{}
+	if err := json.NewDecoder(rr.Body).Decode(&detail); err != nil {
+		t.Fatalf("unexpected detail response %d: %v", rr.Code, err)
+	}
+	if len(detail.Lists) != 2 || detail.Lists[0].State != "enabled" || detail.Lists[1].State != "disabled" || !slices.Equal(detail.Lists[1].Tags, []string{"kids"}) {
+		t.Errorf("unexpected detail %+v", detail)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/domains/missing.example.org", nil))
+	if rr.Code != 404 {
+		t.Errorf("expected a missing domain to be not found, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	b.dumpEntries(rr, httptest.NewRequest("GET", "/dump_domains", nil))
+	dumped := []string{}
+	json.NewDecoder(rr.Body).Decode(&dumped)
+	if len(dumped) != 41 {
+		t.Errorf("expected dump_domains to return all 41 domains, got %d", len(dumped))
+	}
+}
@@ -3,9 +3,15 @@ package block
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,7 +23,134 @@ var blocklists = []string{"https://raw.githubusercontent.com/StevenBlack/hosts/m
 
 var DLmtx sync.RWMutex
 
-func (b *Block) dbStagingDownload(db *bolt.DB, url string, list_id int) error {
+// lists fetched at the same time unless DownloadWorkers is configured
+var gDefaultDownloadWorkers = 4
+
+// ListStatus reports the outcome of the last download of a block list
+type ListStatus struct {
+	URI         string
+	LastAttempt int64 //unix time of the last download
+	LastSuccess int64 //unix time of the last successful download
+	Error       string
+	Verified    bool   //the last good copy passed checksum or signature verification
+	DownloadMs  int64  //time the last download took
+	Source      string //the URI or mirror the last good copy came from
+	Failures    int    //consecutive failed downloads
+	NextRetry   int64  //unix time of the next retry after a failure
+	Domains     int64  //domains the list has in the database
+	Added       int64  //domains added by the last update
+	Removed     int64  //domains removed by the last update
+	Fingerprint string //sha256 of the last good copy, after decompression
+}
+
+var gListStatus = map[string]ListStatus{}
+var LSmtx sync.RWMutex
+
+func getListStatus(uri string) ListStatus {
+	LSmtx.RLock()
+	defer LSmtx.RUnlock()
+
+	status, exists := gListStatus[uri]
+	if !exists {
+		status.URI = uri
+	}
+	return status
+}
+
+func setListStatus(entry ListEntry, err error, took time.Duration) {
+	LSmtx.Lock()
+	defer LSmtx.Unlock()
+
+	status := gListStatus[entry.URI]
+	status.URI = entry.URI
+	status.LastAttempt = time.Now().Unix()
+	status.DownloadMs = took.Milliseconds()
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Error = ""
+		status.LastSuccess = status.LastAttempt
+		status.Verified = entry.needsVerification()
+	}
+	gListStatus[entry.URI] = status
+}
+
+func setListRetry(uri string, failures int, next time.Time) {
+	LSmtx.Lock()
+	defer LSmtx.Unlock()
+
+	status := gListStatus[uri]
+	status.URI = uri
+	status.Failures = failures
+	status.NextRetry = 0
+	if !next.IsZero() {
+		status.NextRetry = next.Unix()
+	}
+	gListStatus[uri] = status
+}
+
+func setListCounts(uri string, domains int64, added int64, removed int64) {
+	LSmtx.Lock()
+	defer LSmtx.Unlock()
+
+	status := gListStatus[uri]
+	status.URI = uri
+	status.Domains = domains
+	status.Added = added
+	status.Removed = removed
+	gListStatus[uri] = status
+}
+
+func setListSource(uri string, source string, fingerprint string) {
+	LSmtx.Lock()
+	defer LSmtx.Unlock()
+
+	status := gListStatus[uri]
+	status.URI = uri
+	status.Source = source
+	status.Fingerprint = fingerprint
+	gListStatus[uri] = status
+}
+
+// dbStagingDownload stores the domains of entry in the list bucket of
+// list_id in db, trying the URI and
+// then each of the Mirrors until one succeeds.
+func (b *Block) dbStagingDownload(db *bolt.DB, entry ListEntry, list_id int) error {
+	sources := append([]string{entry.URI}, entry.Mirrors...)
+	errs := []error{}
+
+	for i, url := range sources {
+		counter := &listCounter{limits: b.listLimits(entry), totals: b.totals}
+		fingerprint, err := b.dbStagingDownloadURI(db, entry, url, list_id, counter)
+		if err == nil {
+			if i > 0 {
+				log.Infof("Block list %q loaded from mirror %q", entry.URI, url)
+			}
+			setListSource(entry.URI, url, fingerprint)
+			return nil
+		}
+
+		//only the copy that is kept counts toward the totals of the refresh
+		counter.release()
+		errs = append(errs, err)
+		if i+1 < len(sources) {
+			log.Warningf("Block list %q failed, trying next mirror: %s", url, err)
+			//drop what the failed attempt stored before trying the next mirror
+			if err := clearList(db, list_id); err != nil {
+				return errors.Join(append(errs, err)...)
+			}
+		}
+	}
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+// dbStagingDownloadURI stores the domains of the list at url in db and
+// returns the sha256 of the list as read. What it reads is counted by counter.
+func (b *Block) dbStagingDownloadURI(db *bolt.DB, entry ListEntry, url string, list_id int, counter *listCounter) (string, error) {
 	var err error
 
 	ctx, cancel := context.WithTimeout(context.Background(), 35*time.Second)
@@ -26,165 +159,421 @@ func (b *Block) dbStagingDownload(db *bolt.DB, url string, list_id int) error {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		// handle error
-		return err
+		return "", err
 	}
 	req = req.WithContext(ctx)
+	req.Header.Set("Accept-Encoding", listAcceptEncoding)
 
-	client := &http.Client{}
+	client, err := b.listClient(entry, url)
+	if err != nil {
+		return "", err
+	}
 	defer client.CloseIdleConnections()
 	resp, err := client.Do(req)
 	if err != nil {
 		// handle error
 		fmt.Println("Download Request failed", err)
-		return err
+		return "", err
 	}
 
 	defer resp.Body.Close()
-	scanner := bufio.NewScanner(resp.Body)
-	done := make(chan bool)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download of %s failed: %s", url, resp.Status)
+	}
+
+	if counter.limits.MaxBytes > 0 && resp.ContentLength > counter.limits.MaxBytes {
+		return "", limitError("%d bytes announced, limit is %d", resp.ContentLength, counter.limits.MaxBytes)
+	}
+	resp.Body = &countedBody{resp.Body, counter}
+
+	encoded, err := decodeContentEncoding(resp)
+	if err != nil {
+		return "", err
+	}
+	defer encoded.Close()
+
+	var published io.Reader = encoded
+	if entry.needsVerification() {
+		//the whole list has to be checked before anything is stored
+		spool, err := spoolVerified(ctx, client, entry, url, encoded)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		published = spool
+	}
+
+	body, err := decompressList(published, listCompressionHint(resp, url))
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	digest := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(body, digest))
+	done := make(chan error, 1)
 
 	batchSize := 16384
 	batch := make([]string, batchSize)
 	i := 0
 	go func() {
 		for scanner.Scan() {
+			if err := counter.addLine(); err != nil {
+				done <- err
+				return
+			}
+
 			// process each line
 			ok, domain := lineRead(scanner.Text())
 			if !ok {
 				continue
 			}
 
+			if err := counter.addDomain(); err != nil {
+				done <- err
+				return
+			}
+
 			batch[i] = domain
 			i++
 
 			if i%batchSize == 0 {
-				storeBatch(db, batch, i, list_id)
+				storeListBatch(db, batch, i, list_id)
 				i = 0
 			}
 
 		}
 
 		//store the rest
-		storeBatch(db, batch, i, list_id)
-		done <- true
+		storeListBatch(db, batch, i, list_id)
+		done <- scanner.Err()
 
 	}()
 
 	select {
-	case <-done:
+	case err = <-done:
 		// reading finished
-		return err
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(digest.Sum(nil)), nil
 	case <-ctx.Done():
-		// timeout
+		// timeout, the cancelled request ends the reader. wait for it so
+		// nothing is written to db after returning
 		fmt.Println("context cancelled, reason:", ctx.Err())
-		return errors.New("processing list timed out for " + url)
+		<-done
+		return "", errors.New("processing list timed out for " + url)
+	}
+}
+
+// updateList downloads one list into the staging db and patches the live
+// db with the difference to the copy it has. A list that fails to download,
+// fails verification or breaks a limit keeps its previous copy.
+func (b *Block) updateList(staging *bolt.DB, entry ListEntry) error {
+	url := entry.URI
+	log.Infof("Block list update started %q", url)
+
+	start := time.Now()
+	err := b.dbStagingDownload(staging, entry, entry.ID)
+	setListStatus(entry, err, time.Since(start))
+	if err != nil {
+		listErrors.WithLabelValues(strconv.Itoa(entry.ID)).Inc()
+		log.Warningf("Failed to update block list %q, keeping the previous copy: %s", url, err)
+		clearList(staging, entry.ID)
+		return err
+	}
+
+	status := getListStatus(url)
+
+	Dmtx.RLock()
+	added, removed, err := applyList(b.db(), staging, entry.ID, b.patched)
+	domains := listDomainCount(b.db(), entry.ID)
+	if err == nil {
+		err = setListMeta(b.db(), ListMeta{
+			ID:          entry.ID,
+			URI:         url,
+			Source:      status.Source,
+			Fingerprint: status.Fingerprint,
+			SHA256:      entry.SHA256,
+			PublicKey:   entry.PublicKey,
+			Domains:     domains,
+		})
+	}
+	Dmtx.RUnlock()
+	clearList(staging, entry.ID)
+	if err != nil {
+		listErrors.WithLabelValues(strconv.Itoa(entry.ID)).Inc()
+		log.Warningf("Failed to apply block list %q: %s", url, err)
+		return err
 	}
+	setListCounts(url, domains, added, removed)
 
-	return err
+	log.Infof("Block list update finished %q in %s: %d domains, %d added, %d removed",
+		url, time.Since(start).Round(time.Millisecond), domains, added, removed)
+	return nil
 }
-func (b *Block) download() {
 
-	go func() {
-		DLmtx.Lock()
-		defer DLmtx.Unlock()
-
-		list_ids := []int{}
-		if b.superapi_enabled {
-			//override blocklist with config
-			blocklists = []string{}
-			BLmtx.RLock()
-			for i, entry := range b.config.BlockLists {
-				if entry.Enabled {
-					blocklists = append(blocklists, entry.URI)
-					list_ids = append(list_ids, i)
-				}
-			}
-			BLmtx.RUnlock()
+// configuredListIDs returns the ids of all lists in the configuration,
+// enabled or not
+func (b *Block) configuredListIDs() []int {
+	ids := []int{}
+	if !b.superapi_enabled {
+		for i := range blocklists {
+			ids = append(ids, i)
 		}
+		return ids
+	}
+
+	BLmtx.RLock()
+	defer BLmtx.RUnlock()
+	for _, entry := range b.config.BlockLists {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+// collectGarbage drops the domains of lists that were deleted from the
+// configuration. Disabled lists are kept so they can be enabled again
+// without a download.
+func (b *Block) collectGarbage() {
+	DLmtx.Lock()
+	defer DLmtx.Unlock()
+	b.collectGarbageLocked()
+}
 
-		memEfficient := true
+func (b *Block) collectGarbageLocked() {
+	configured := b.configuredListIDs()
 
-		var db *bolt.DB
+	Dmtx.RLock()
+	defer Dmtx.RUnlock()
 
-		if memEfficient {
-			Stagemtx.Lock()
-			db = BoltOpen(b.DbPath + "-staging")
+	ids, err := storedListIDs(b.db())
+	if err != nil {
+		log.Warningf("Failed to read stored block lists: %s", err)
+		return
+	}
+
+	for _, list_id := range ids {
+		if slices.Contains(configured, list_id) {
+			continue
+		}
+		removed, err := dropList(b.db(), list_id, b.patched)
+		if err != nil {
+			log.Warningf("Failed to drop block list %d: %s", list_id, err)
+			continue
 		}
+		listErrors.DeleteLabelValues(strconv.Itoa(list_id))
+		log.Infof("Deleted block list %d dropped, %d domains removed", list_id, removed)
+	}
+
+	gMetrics.BlockedDomains.Store(getCount(b.db(), gDomainBucket))
+}
 
+// downloadLists refreshes the enabled lists, or with only set just the
+// enabled lists with those URIs. Up to DownloadWorkers lists are fetched at
+// the same time into a staging db, and each list is applied to the live db
+// on its own as soon as it is complete. A full refresh also collects the
+// garbage of deleted lists. The result maps the URI of each list attempted
+// to its error.
+func (b *Block) downloadLists(only []string) map[string]error {
+	DLmtx.Lock()
+	defer DLmtx.Unlock()
+
+	start := time.Now()
+	results := map[string]error{}
+
+	selected := func(uri string) bool {
+		return only == nil || slices.Contains(only, uri)
+	}
+
+	workers := gDefaultDownloadWorkers
+	lists := []ListEntry{}
+	totals := newDownloadTotals(nil)
+	if b.superapi_enabled {
+		//override blocklist with config
+		BLmtx.Lock()
+		b.config.assignListIDs()
+		for _, entry := range b.config.BlockLists {
+			if entry.Enabled && selected(entry.URI) {
+				lists = append(lists, entry)
+			}
+		}
+		if b.config.DownloadWorkers > 0 {
+			workers = b.config.DownloadWorkers
+		}
+		totals = newDownloadTotals(b.config.TotalLimits)
+		BLmtx.Unlock()
+	} else {
 		for i, url := range blocklists {
-			log.Infof("Block list update started %q", url)
-
-			if memEfficient {
-				//mem efficient download
-				b.dbStagingDownload(db, url, list_ids[i])
-			} else {
-				resp, err := http.Get(url)
-				if err != nil {
-					log.Warningf("Failed to download block list %q: %s", url, err)
-					continue
-				}
-				if err := listRead(resp.Body, b.update, int(list_ids[i])); err != nil {
-					log.Warningf("Failed to parse block list %q: %s", url, err)
-				}
-				resp.Body.Close()
-
-				log.Infof("Block list update finished %q %d", url, len(b.update))
+			if selected(url) {
+				lists = append(lists, ListEntry{URI: url, Enabled: true, ID: i})
 			}
 		}
+	}
+
+	if only != nil && len(lists) == 0 {
+		return results
+	}
+
+	b.totals = totals
+
+	Stagemtx.Lock()
+	//never build on top of a staging db left behind by an interrupted run
+	os.Remove(b.DbPath + "-staging")
+	db, err := boltOpen(b.DbPath+"-staging", &bolt.Options{Timeout: 1 * time.Second, NoSync: true})
+	if err != nil {
+		Stagemtx.Unlock()
+		b.totals = nil
+		log.Warningf("Failed to create staging database: %s", err)
+		for _, entry := range lists {
+			results[entry.URI] = err
+			listErrors.WithLabelValues(strconv.Itoa(entry.ID)).Inc()
+		}
+		return results
+	}
 
-		log.Infof("Updating database with new domains")
+	var resultsmtx sync.Mutex
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, entry := range lists {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(entry ListEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := b.updateList(db, entry)
+			resultsmtx.Lock()
+			results[entry.URI] = err
+			resultsmtx.Unlock()
+		}(entry)
+	}
+	wg.Wait()
+	b.totals = nil
+
+	db.Close()
+	os.Remove(b.DbPath + "-staging")
+	Stagemtx.Unlock()
+
+	if only == nil {
+		b.collectGarbageLocked()
+		if b.rebuilding.Load() {
+			log.Infof("Database rebuilt from the block lists")
+			b.setRebuilding(false)
+		}
+	}
 
-		if memEfficient {
-			Dmtx.Lock()
-			db.Close()
-			b.transferStagingDB()
-			Stagemtx.Unlock()
-			Dmtx.Unlock()
-		} else {
-			Dmtx.Lock()
-			b.UpdateDomains(b.update)
-			Dmtx.Unlock()
-			b.update = make(map[string]DomainValue)
+	//start over with a filter sized for the lists and without the domains
+	//that were removed
+	Dmtx.RLock()
+	gMetrics.BlockedDomains.Store(getCount(b.db(), gDomainBucket))
+	b.rebuildFilterLocked()
+	updateListMetrics(b.db())
+	Dmtx.RUnlock()
+
+	elapsed := time.Since(start)
+	now := time.Now().Unix()
+	gMetrics.LastRefresh.Store(now)
+	lastRefresh.Set(float64(now))
+	gMetrics.LastRefreshMilliseconds.Store(elapsed.Milliseconds())
+
+	log.Infof("Block lists updated: %d domains in %s", gMetrics.BlockedDomains.Load(), elapsed.Round(time.Millisecond))
+
+	//the refresh patched the live db without syncing, keep a synced copy
+	//to fall back to after a crash
+	for _, err := range results {
+		if err == nil {
+			Dmtx.RLock()
+			err = backupDB(b.db(), b.DbPath)
+			Dmtx.RUnlock()
+			if err != nil {
+				log.Warningf("Failed to back up %s: %s", b.DbPath, err)
+			}
+			break
 		}
+	}
+
+	if only == nil {
+		b.compactIfFragmented()
+	}
 
-		log.Infof("Block lists updated: %d domains added", gMetrics.BlockedDomains)
+	return results
+}
+
+// download refreshes all lists in the background, failed lists are handed
+// to the retry scheduler.
+func (b *Block) download() {
+	go func() {
+		b.retries.record(b.downloadLists(nil))
 	}()
 }
-func (b *Block) ShouldRetryRefresh() bool {
-	//no lists
-	if len(b.config.BlockLists) == 0 {
+
+// downloadList fetches the list with uri on its own, handing a failure to
+// the retry scheduler.
+func (b *Block) downloadList(uri string) {
+	b.retries.record(b.downloadLists([]string{uri}))
+}
+
+// hasListData reports if the live db has domains for list_id
+func (b *Block) hasListData(list_id int) bool {
+	h := b.acquire()
+	if h == nil {
 		return false
 	}
+	defer h.release()
+	return listDomainCount(h.db, list_id) > 0
+}
 
-	//already have some blocked, dont retry
-	if gMetrics.BlockedDomains != 0 {
-		return false
+// isListActive reports if uri is still a list that gets downloaded
+func (b *Block) isListActive(uri string) bool {
+	if !b.superapi_enabled {
+		return slices.Contains(blocklists, uri)
 	}
 
-	return true
+	BLmtx.RLock()
+	defer BLmtx.RUnlock()
+	for _, entry := range b.config.BlockLists {
+		if entry.URI == uri {
+			return entry.Enabled
+		}
+	}
+	return false
 }
 
+// refresh downloads all lists on start and then every RefreshSeconds,
+// retrying failed lists with backoff in between. It returns once b.stop is
+// closed, without waiting for a pending retry.
 func (b *Block) refresh() {
+	b.retries.record(b.downloadLists(nil))
+
 	refreshTime := time.Hour * 24 * 7
 	if b.config.RefreshSeconds > 0 {
 		refreshTime = time.Duration(b.config.RefreshSeconds) * time.Second
 	}
 	tick := time.NewTicker(refreshTime)
 	defer tick.Stop()
+
+	retry := time.NewTimer(time.Hour)
+	defer retry.Stop()
+
 	for {
+		retry.Stop()
+		if next, ok := b.retries.next(); ok {
+			retry.Reset(max(time.Until(next), 0))
+		}
+
 		select {
 		case <-tick.C:
-
-			retries := 3
-			for retries > 0 {
-				b.download()
-				if !b.ShouldRetryRefresh() {
-					break
-				}
-				retries--
-				time.Sleep(time.Minute * 5)
+			b.retries.record(b.downloadLists(nil))
+		case <-retry.C:
+			b.retries.forget(b.isListActive)
+			due := b.retries.due(time.Now())
+			if len(due) > 0 {
+				b.retries.record(b.downloadLists(due))
 			}
-
+		case <-b.retries.kick:
+			//schedule changed, re-arm the retry timer
 		case <-b.stop:
 			return
 		}
@@ -4,8 +4,15 @@ import (
 	//"os"
 	//"strings
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"runtime"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestDownload(t *testing.T) {
@@ -22,27 +29,91 @@ func TestDownload(t *testing.T) {
 		"https://raw.githubusercontent.com/blocklistproject/Lists/master/porn.txt"}
 
 	for i, entry := range lists {
-		err := b.dbStagingDownload(db, entry, i)
+		err := b.dbStagingDownload(db, ListEntry{URI: entry}, i)
 		if err != nil {
 			log.Fatal("failed to download", err)
 		}
 	}
 
-	fmt.Println("done", getCount(db, gDomainBucket))
+	for i := range lists {
+		fmt.Println("done", listDomainCount(db, i))
+		_, _, err := applyList(b.db(), db, i, b.domainStore().Reload)
+		if err != nil {
+			log.Fatal("failed to apply list", err)
+		}
+	}
 
 	db.Close()
-	err := b.transferStagingDB()
-	if err != nil {
-		log.Fatal("failed x staging", err)
-	}
+	gMetrics.BlockedDomains.Store(getCount(b.db(), gDomainBucket))
 
-	fmt.Println(gMetrics.BlockedDomains)
+	fmt.Println(gMetrics.BlockedDomains.Load())
 
 	runtime.GC()
 
 	printMemUsage(t)
 }
 
+func TestParallelDownload(t *testing.T) {
+	var active, peak int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		} else {
+			time.Sleep(50 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "0.0.0.0 shared.example.com\n0.0.0.0 %s.example.com\n", r.URL.Path[1:])
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/parallel.db")
+	b := New()
+	b.setupDB("/tmp/parallel.db")
+	b.superapi_enabled = true
+	b.config.DownloadWorkers = 2
+
+	paths := []string{"slow", "a", "b", "c", "d", "e"}
+	for _, path := range paths {
+		b.config.BlockLists = append(b.config.BlockLists, ListEntry{URI: srv.URL + "/" + path, Enabled: true})
+	}
+
+	b.downloadLists(nil)
+
+	if peak > 2 {
+		t.Errorf("expected at most 2 parallel downloads, saw %d", peak)
+	}
+
+	for i, path := range paths {
+		value, found := b.getDomain(path + ".example.com.")
+		if !found || !slices.Equal(value.List_ids, []int{i}) {
+			t.Errorf("expected %s.example.com. from list %d, got %v", path, i, value.List_ids)
+		}
+		if getListStatus(srv.URL+"/"+path).LastSuccess == 0 {
+			t.Errorf("expected status for list " + strconv.Itoa(i))
+		}
+	}
+
+	value, _ := b.getDomain("shared.example.com.")
+	if !slices.Equal(value.List_ids, []int{0, 1, 2, 3, 4, 5}) {
+		t.Errorf("expected sorted list ids for shared.example.com., got %v", value.List_ids)
+	}
+
+	if gMetrics.LastRefreshMilliseconds.Load() < 500 {
+		t.Errorf("expected refresh time to be reported, got %dms", gMetrics.LastRefreshMilliseconds.Load())
+	}
+
+	b.closeDB()
+}
+
 func printMemUsage(t *testing.T) {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -57,3 +128,49 @@ func printMemUsage(t *testing.T) {
 func bToMb(b uint64) uint64 {
 	return b / 1024 / 1024
 }
+
+func TestMirrorFallback(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//send part of the list, then fail
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("0.0.0.0 partial.example.com\n"))
+	}))
+	defer primary.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0.0.0.0 mirrored.example.com\n"))
+	}))
+	defer mirror.Close()
+
+	os.Remove("/tmp/mirror.db")
+	db := BoltOpen("/tmp/mirror.db")
+	defer db.Close()
+
+	entry := ListEntry{
+		URI:     primary.URL + "/hosts",
+		Mirrors: []string{"http://127.0.0.1:1/hosts", mirror.URL + "/hosts"},
+	}
+
+	b := New()
+	err := b.dbStagingDownload(db, entry, 0)
+	if err != nil {
+		t.Fatalf("expected the mirror to succeed, got %v", err)
+	}
+
+	if !listHas(db, 0, "mirrored.example.com.") {
+		t.Errorf("missing mirrored.example.com.")
+	}
+	if listHas(db, 0, "partial.example.com.") {
+		t.Errorf("expected data of the failed attempt to be dropped")
+	}
+
+	if source := getListStatus(entry.URI).Source; source != mirror.URL+"/hosts" {
+		t.Errorf("expected mirror as source, got %q", source)
+	}
+
+	entry.Mirrors = []string{"http://127.0.0.1:1/hosts"}
+	err = b.dbStagingDownload(db, entry, 0)
+	if err == nil {
+		t.Errorf("expected failure when all mirrors fail")
+	}
+}
@@ -0,0 +1,159 @@
+package block
+
+import (
+	"encoding/json"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/spr-networks/sprbus"
+)
+
+// events carry their Version, fields are only added under a new version
+var gEventVersion = 2
+
+// kinds of events and their default topics
+var (
+	gEventBlock     = "block"
+	gEventOverride  = "override"
+	gEventRebinding = "rebinding"
+)
+
+var gEventTopics = map[string]string{
+	gEventBlock:     "dns:block:event",
+	gEventOverride:  "dns:override:event",
+	gEventRebinding: "dns:blockrebind:event",
+}
+
+// a topic configured as - is not published
+var gEventTopicOff = "-"
+
+// EventTopics overrides the sprbus topic of each kind of event
+type EventTopics struct {
+	Block     string `json:",omitempty"`
+	Override  string `json:",omitempty"`
+	Rebinding string `json:",omitempty"`
+}
+
+// EventDevice identifies the client by the SPR device using its address
+type EventDevice struct {
+	Name string
+	MAC  string
+}
+
+// EventDetails describes the decision behind an event
+type EventDetails struct {
+	Version      int
+	QType        string
+	MatchedName  string   `json:",omitempty"` //the label that decided
+	ListIDs      []int    `json:",omitempty"`
+	ListURIs     []string `json:",omitempty"`
+	Categories   []string `json:",omitempty"`
+	OverrideList string   `json:",omitempty"` //override list, quarantine or client exclusion that decided
+	Action       string   //blocked, override, rebinding or quarantine
+	Rcode        string
+	Device       *EventDevice `json:",omitempty"`
+}
+
+type DNSBlockEvent struct {
+	ClientIP string
+	Name     string
+	EventDetails
+}
+
+type DNSOverrideEvent struct {
+	ClientIP string
+	IP       string // the new IP response
+	Name     string
+	EventDetails
+}
+
+type DNSBlockRebindingEvent struct {
+	ClientIP  string
+	BlockedIP string
+	Name      string
+	EventDetails
+}
+
+func (i *DNSBlockEvent) String() string {
+	x, _ := json.Marshal(i)
+	return string(x)
+}
+
+func (i *DNSOverrideEvent) String() string {
+	x, _ := json.Marshal(i)
+	return string(x)
+}
+
+func (i *DNSBlockRebindingEvent) String() string {
+	x, _ := json.Marshal(i)
+	return string(x)
+}
+
+func deviceByIP(IP string) *EventDevice {
+	IPTagmtx.RLock()
+	device, exists := IPDeviceMap[IP]
+	IPTagmtx.RUnlock()
+	if !exists {
+		return nil
+	}
+	return &device
+}
+
+func (b *Block) eventDetails(state request.Request, action string, rcode int, tr *lookupTrace, categories []string) EventDetails {
+	details := EventDetails{
+		Version:      gEventVersion,
+		QType:        state.Type(),
+		MatchedName:  tr.label,
+		ListIDs:      tr.list_ids,
+		Categories:   categories,
+		OverrideList: tr.override,
+		Action:       metricAction(action, tr),
+		Rcode:        dns.RcodeToString[rcode],
+		Device:       deviceByIP(state.IP()),
+	}
+
+	if len(tr.list_ids) > 0 {
+		BLmtx.RLock()
+		for _, list_id := range tr.list_ids {
+			if list, exists := b.listByIDLocked(list_id); exists {
+				details.ListURIs = append(details.ListURIs, list.URI)
+			}
+		}
+		BLmtx.RUnlock()
+	}
+	return details
+}
+
+// eventTopic returns the topic of a kind of event, empty when it is off
+func (b *Block) eventTopic(kind string) string {
+	topic := ""
+	topics := b.config.EventTopics
+	if topics == nil {
+		topics = &EventTopics{}
+	}
+	switch kind {
+	case gEventBlock:
+		topic = topics.Block
+	case gEventOverride:
+		topic = topics.Override
+	case gEventRebinding:
+		topic = topics.Rebinding
+	}
+	if topic == gEventTopicOff {
+		return ""
+	}
+	if topic == "" {
+		topic = gEventTopics[kind]
+	}
+	return topic
+}
+
+var publishString = func(topic string, value string) {
+	sprbus.PublishString(topic, value)
+}
+
+func (b *Block) publishEvent(kind string, event interface{ String() string }) {
+	if topic := b.eventTopic(kind); topic != "" {
+		publishString(topic, event.String())
+	}
+}
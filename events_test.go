@@ -0,0 +1,102 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+type publishedEvent struct {
+	topic string
+	value string
+}
+
+func TestEvents(t *testing.T) {
+	var mtx sync.Mutex
+	published := []publishedEvent{}
+	saved := publishString
+	defer func() { publishString = saved }()
+	publishString = func(topic string, value string) {
+		mtx.Lock()
+		published = append(published, publishedEvent{topic, value})
+		mtx.Unlock()
+	}
+
+	//test.ResponseWriter queries from 10.240.0.1
+	IPTagmtx.Lock()
+	IPDeviceMap = map[string]EventDevice{"10.240.0.1": {"laptop", "00:11:22:33:44:55"}}
+	IPTagmtx.Unlock()
+	defer func() {
+		IPTagmtx.Lock()
+		IPDeviceMap = map[string]EventDevice{}
+		IPTagmtx.Unlock()
+	}()
+
+	b, srv := newTestBlock(t, "0.0.0.0 ads.example.com\n", []OverrideList{{Name: "main", Enabled: true,
+		PermitDomains: []DomainOverride{{Type: "Permit", Domain: "local.example.org.", ResultIP: "192.168.2.10", ClientIP: "*"}},
+	}})
+	b.config.EventTopics = &EventTopics{Override: "custom:override"}
+
+	for _, name := range []string{"www.ads.example.com.", "local.example.org.", "private.example.org.", "good.example.org."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		b.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	}
+
+	topics := []string{}
+	for _, event := range published {
+		topics = append(topics, event.topic)
+	}
+	if !slices.Equal(topics, []string{"dns:block:event", "custom:override", "dns:blockrebind:event"}) {
+		t.Fatalf("unexpected topics %v", topics)
+	}
+
+	block := DNSBlockEvent{}
+	json.Unmarshal([]byte(published[0].value), &block)
+	if block.Version != gEventVersion || block.Name != "www.ads.example.com." || block.MatchedName != "ads.example.com." ||
+		block.QType != "A" || block.Action != "blocked" || block.Rcode != "NXDOMAIN" {
+		t.Errorf("unexpected block event %+v", block)
+	}
+	if !slices.Equal(block.ListURIs, []string{srv + "/ads"}) || len(block.ListIDs) != 1 || !slices.Equal(block.Categories, []string{"ads"}) {
+		t.Errorf("expected the list and category of the block, got %+v", block)
+	}
+	if block.Device == nil || block.Device.Name != "laptop" || block.Device.MAC != "00:11:22:33:44:55" {
+		t.Errorf("expected the device of the client, got %+v", block.Device)
+	}
+
+	override := DNSOverrideEvent{}
+	json.Unmarshal([]byte(published[1].value), &override)
+	if override.IP != "192.168.2.10" || override.OverrideList != "main" || override.MatchedName != "local.example.org." ||
+		override.Action != "override" || override.Rcode != "NOERROR" {
+		t.Errorf("unexpected override event %+v", override)
+	}
+
+	rebinding := DNSBlockRebindingEvent{}
+	json.Unmarshal([]byte(published[2].value), &rebinding)
+	if rebinding.BlockedIP != "192.168.1.1" || rebinding.Action != "rebinding" || rebinding.Rcode != "NXDOMAIN" || rebinding.Version != gEventVersion {
+		t.Errorf("unexpected rebinding event %+v", rebinding)
+	}
+
+	//a topic set to - is not published
+	published = published[:0]
+	b.config.EventTopics = &EventTopics{Block: "-"}
+	req := new(dns.Msg)
+	req.SetQuestion("www.ads.example.com.", dns.TypeA)
+	b.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	if len(published) != 0 {
+		t.Errorf("expected no event on a disabled topic, got %v", published)
+	}
+
+	//the override answers A and AAAA only, other types are forwarded
+	b.config.EventTopics = nil
+	req.SetQuestion("local.example.org.", dns.TypeMX)
+	b.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	if len(published) != 0 {
+		t.Errorf("expected no override event for a forwarded query, got %v", published)
+	}
+}
@@ -0,0 +1,154 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TraceStep is one check of a lookup decision
+type TraceStep struct {
+	Stage  string //exclusion, quarantine, override, lookup, list or tags
+	Name   string `json:",omitempty"` //the label checked
+	Detail string
+}
+
+// lookupTrace records the decision of a lookup: what decided it and the
+// lists the name was found on, for the metrics, events and query log of a
+// query. Only a verbose one records every step, callers check verbose
+// before add so the arguments of a step are not formatted otherwise.
+type lookupTrace struct {
+	verbose     bool
+	steps       []TraceStep
+	list_ids    []int
+	override    string //the override list that decided
+	label       string //the override entry that decided, or the label last found on a list
+	quarantined bool   //the client is quarantined
+}
+
+func (t *lookupTrace) add(stage string, name string, format string, args ...interface{}) {
+	t.steps = append(t.steps, TraceStep{stage, name, fmt.Sprintf(format, args...)})
+}
+
+// matched records the override that decided the lookup
+func (t *lookupTrace) matched(override string) {
+	if t != nil {
+		t.override = override
+	}
+}
+
+// quarantine records that the quarantine of the client decided the lookup
+func (t *lookupTrace) quarantine() {
+	if t != nil {
+		t.override = "quarantine"
+		t.quarantined = true
+	}
+}
+
+// matchedDomain records the override entry that matched
+func (t *lookupTrace) matchedDomain(domain string) {
+	if t != nil {
+		t.label = domain
+	}
+}
+
+// hit records the lists label was found in
+func (t *lookupTrace) hit(label string, list_ids []int) {
+	if t == nil {
+		return
+	}
+	t.label = label
+	for _, list_id := range list_ids {
+		if !slices.Contains(t.list_ids, list_id) {
+			t.list_ids = append(t.list_ids, list_id)
+		}
+	}
+}
+
+type Explanation struct {
+	Name        string
+	Client      string
+	QType       string
+	Policies    []string //dns policies of the client
+	Steps       []TraceStep
+	ListIDs     []int
+	Categories  []string
+	Blocked     bool
+	Action      string //what ServeDNS does with the query
+	ResultIP    string `json:",omitempty"`
+	ResultCNAME string `json:",omitempty"`
+}
+
+// explain runs the decision of ServeDNS for a query of qtype for name from
+// client, without sending a query
+func (b *Block) explain(name string, client string, qtype uint16) Explanation {
+	tr := &lookupTrace{verbose: true}
+	returnIP := ""
+	returnCNAME := ""
+	categories := []string{}
+	hasPermit := false
+
+	blocked := b.blockedTrace(client, name, &returnIP, &returnCNAME, &hasPermit, &categories, tr)
+
+	ex := Explanation{
+		Name:        name,
+		Client:      client,
+		QType:       dns.TypeToString[qtype],
+		Policies:    b.getClientDnsPolicies(client),
+		Steps:       tr.steps,
+		ListIDs:     tr.list_ids,
+		Categories:  categories,
+		Blocked:     blocked,
+		ResultIP:    returnIP,
+		ResultCNAME: returnCNAME,
+	}
+	if ex.ListIDs == nil {
+		ex.ListIDs = []int{}
+	}
+
+	//the same order of checks as ServeDNS
+	switch {
+	case blocked:
+		ex.Action = "block with NXDOMAIN"
+	case returnIP != "" && (qtype == dns.TypeA || qtype == dns.TypeAAAA):
+		ex.Action = "answer with " + returnIP
+	case returnIP == "" && returnCNAME != "":
+		ex.Action = "answer with CNAME " + returnCNAME
+	case !hasPermit && !b.config.RebindingCheckDisable:
+		ex.Action = "forward, blocking private answers (rebinding check)"
+	default:
+		ex.Action = "forward"
+	}
+
+	return ex
+}
+
+func (b *Block) explainLookup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name", 400)
+		return
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	if _, ok := dns.IsDomainName(name); !ok {
+		http.Error(w, "invalid name", 400)
+		return
+	}
+
+	qtype := dns.TypeA
+	if q := r.URL.Query().Get("qtype"); q != "" {
+		t, ok := dns.StringToType[strings.ToUpper(q)]
+		if !ok {
+			http.Error(w, "invalid qtype", 400)
+			return
+		}
+		qtype = t
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.explain(name, r.URL.Query().Get("client"), qtype))
+}
@@ -0,0 +1,114 @@
+package block
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func hasStep(ex Explanation, stage string, detail string) bool {
+	return slices.ContainsFunc(ex.Steps, func(step TraceStep) bool {
+		return step.Stage == stage && strings.Contains(step.Detail, detail)
+	})
+}
+
+func TestExplain(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0.0.0.0 ads.example.com\n"))
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/explain_test.db")
+	b := New()
+	b.setupDB("/tmp/explain_test.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{
+		{URI: srv.URL + "/ads", Enabled: true, Category: "ads"},
+	}
+	b.config.ClientIPExclusions = []string{"192.168.2.99"}
+	b.config.OverrideLists = []OverrideList{
+		{Name: "off", Enabled: false},
+		{Name: "main", Enabled: true, PermitDomains: []DomainOverride{
+			{Type: "Permit", Domain: "ok.ads.example.com.", ClientIP: "*"},
+			{Type: "Permit", Domain: "local.ads.example.com.", ClientIP: "*", ResultIP: "192.168.2.5"},
+		}},
+	}
+	b.downloadLists(nil)
+	rejected, falsePositives := gMetrics.FilterRejected.Load(), gMetrics.FilterFalsePositives.Load()
+
+	ex := b.explain("www.ads.example.com.", "192.168.2.10", 1)
+	if !ex.Blocked || ex.Action != "block with NXDOMAIN" {
+		t.Errorf("expected www.ads.example.com. to be blocked, got %+v", ex)
+	}
+	if !slices.Equal(ex.ListIDs, []int{0}) || !slices.Equal(ex.Categories, []string{"ads"}) {
+		t.Errorf("expected list 0 and category ads, got %v %v", ex.ListIDs, ex.Categories)
+	}
+	if !slices.ContainsFunc(ex.Steps, func(step TraceStep) bool { return step.Stage == "lookup" && step.Name == "www.ads.example.com." }) {
+		t.Errorf("expected every label to be looked up")
+	}
+	for _, step := range [][2]string{
+		{"exclusion", "is not excluded"},
+		{"quarantine", "not quarantined"},
+		{"override", `"off" skipped, disabled`},
+		{"override", `"main" has no matching entry`},
+		{"lookup", "found in lists [0]"},
+		{"list", "category \"ads\""},
+		{"tags", "no list of the domain is limited to tags"},
+	} {
+		if !hasStep(ex, step[0], step[1]) {
+			t.Errorf("expected a %s step %q in %+v", step[0], step[1], ex.Steps)
+		}
+	}
+
+	ex = b.explain("ok.ads.example.com.", "192.168.2.10", 1)
+	if ex.Blocked || ex.Action != "forward" || !hasStep(ex, "override", `permitted by override list "main"`) {
+		t.Errorf("expected the permit override to apply, got %+v", ex)
+	}
+
+	ex = b.explain("www.ads.example.com.", "192.168.2.99", 1)
+	if ex.Blocked || !hasStep(ex, "exclusion", "is excluded") {
+		t.Errorf("expected the excluded client to pass, got %+v", ex)
+	}
+
+	if gMetrics.FilterRejected.Load() != rejected || gMetrics.FilterFalsePositives.Load() != falsePositives {
+		t.Errorf("expected explanations to leave the filter metrics alone")
+	}
+
+	//the decision is the one of blocked
+	returnIP, returnCNAME, hasPermit, categories := "", "", false, []string{}
+	if b.blocked("192.168.2.10", "www.ads.example.com.", &returnIP, &returnCNAME, &hasPermit, &categories) != true {
+		t.Errorf("expected blocked to agree with the explanation")
+	}
+
+	for _, test := range []struct {
+		query  string
+		code   int
+		action string
+	}{
+		{"/explain?name=local.ads.example.com&client=192.168.2.10", 200, "answer with 192.168.2.5"},
+		{"/explain?name=local.ads.example.com&client=192.168.2.10&qtype=mx", 200, "forward"},
+		{"/explain?name=other.example.org&client=192.168.2.10", 200, "forward, blocking private answers (rebinding check)"},
+		{"/explain?name=other.example.org&qtype=bogus", 400, ""},
+		{"/explain", 400, ""},
+	} {
+		rr := httptest.NewRecorder()
+		b.explainLookup(rr, httptest.NewRequest("GET", test.query, nil))
+		if rr.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.query, test.code, rr.Code)
+			continue
+		}
+		if test.code != 200 {
+			continue
+		}
+		ex := Explanation{}
+		json.NewDecoder(rr.Body).Decode(&ex)
+		if ex.Action != test.action {
+			t.Errorf("%s: expected %q, got %q", test.query, test.action, ex.Action)
+		}
+	}
+}
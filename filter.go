@@ -0,0 +1,131 @@
+package block
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"sync/atomic"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bits per domain and hashes per lookup, for a false positive rate of
+// about 1%
+var gFilterBitsPerDomain = 10
+var gFilterHashes = 7
+
+// bloomFilter answers if a domain may be in the db. It never misses a
+// domain that was added, so a lookup it rejects does not need the db.
+// Domains can be added while it is in use, removed domains stay until the
+// filter is rebuilt.
+type bloomFilter struct {
+	seed  maphash.Seed
+	words []uint64
+	m     uint64 //number of bits
+	k     int
+	n     atomic.Int64 //domains added
+}
+
+func newBloomFilter(domains int64) *bloomFilter {
+	m := uint64(max(domains, 1024) * int64(gFilterBitsPerDomain))
+	m = (m + 63) &^ 63
+	return &bloomFilter{
+		seed:  maphash.MakeSeed(),
+		words: make([]uint64, m/64),
+		m:     m,
+		k:     gFilterHashes,
+	}
+}
+
+// positions derives the k bit positions of name by double hashing
+func (f *bloomFilter) positions(name []byte, fn func(bit uint64) bool) {
+	h := maphash.Bytes(f.seed, name)
+	h2 := bits.RotateLeft64(h, 32) | 1
+	for i := 0; i < f.k; i++ {
+		if !fn(h % f.m) {
+			return
+		}
+		h += h2
+	}
+}
+
+func (f *bloomFilter) add(name []byte) {
+	f.positions(name, func(bit uint64) bool {
+		atomic.OrUint64(&f.words[bit/64], 1<<(bit%64))
+		return true
+	})
+	f.n.Add(1)
+}
+
+func (f *bloomFilter) mayContain(name string) bool {
+	found := true
+	f.positions([]byte(name), func(bit uint64) bool {
+		found = atomic.LoadUint64(&f.words[bit/64])&(1<<(bit%64)) != 0
+		return found
+	})
+	return found
+}
+
+func (f *bloomFilter) sizeBytes() int64 {
+	return int64(len(f.words) * 8)
+}
+
+// falsePositiveRate estimates the chance that a domain not in the filter
+// passes it
+func (f *bloomFilter) falsePositiveRate() float64 {
+	n := float64(f.n.Load())
+	return math.Pow(1-math.Exp(-float64(f.k)*n/float64(f.m)), float64(f.k))
+}
+
+// buildFilter returns a filter of all domains in db
+func buildFilter(db *bolt.DB) (*bloomFilter, error) {
+	var f *bloomFilter
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(gDomainBucket))
+		if bucket == nil {
+			f = newBloomFilter(0)
+			return nil
+		}
+		f = newBloomFilter(int64(bucket.Stats().KeyN))
+		return bucket.ForEach(func(k, v []byte) error {
+			f.add(k)
+			return nil
+		})
+	})
+	return f, err
+}
+
+// rebuildFilterLocked replaces the filter with one built from the live db,
+// with Dmtx held. Without a filter every lookup goes to the store.
+func (b *Block) rebuildFilterLocked() {
+	f, err := buildFilter(b.db())
+	if err != nil {
+		log.Warningf("Failed to build the domain filter: %s", err)
+		b.filter.Store(nil)
+		return
+	}
+	b.filter.Store(f)
+	b.updateFilterMetrics()
+}
+
+func (b *Block) updateFilterMetrics() {
+	f := b.filter.Load()
+	if f == nil {
+		gMetrics.FilterBytes.Store(0)
+		gMetrics.FilterFalsePositiveRate.Store(0)
+		return
+	}
+	gMetrics.FilterBytes.Store(f.sizeBytes())
+	gMetrics.FilterFalsePositiveRate.Store(f.falsePositiveRate())
+}
+
+// patched makes domains changed in the db directly known to the filter
+// and the store
+func (b *Block) patched(domains [][]byte) error {
+	if f := b.filter.Load(); f != nil {
+		for _, domain := range domains {
+			f.add(domain)
+		}
+	}
+	return b.domainStore().Reload(domains)
+}
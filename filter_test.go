@@ -0,0 +1,89 @@
+package block
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	n := 10000
+	f := newBloomFilter(int64(n))
+	for i := 0; i < n; i++ {
+		f.add([]byte(fmt.Sprintf("listed%d.example.com.", i)))
+	}
+
+	for i := 0; i < n; i++ {
+		if !f.mayContain(fmt.Sprintf("listed%d.example.com.", i)) {
+			t.Fatalf("filter misses listed%d.example.com.", i)
+		}
+	}
+
+	passed := 0
+	for i := 0; i < n; i++ {
+		if f.mayContain(fmt.Sprintf("other%d.example.net.", i)) {
+			passed++
+		}
+	}
+	rate := float64(passed) / float64(n)
+	if rate > 0.03 {
+		t.Errorf("false positive rate %.4f is too high", rate)
+	}
+	if estimate := f.falsePositiveRate(); estimate < 0.002 || estimate > 0.02 {
+		t.Errorf("unexpected false positive estimate %.4f, measured %.4f", estimate, rate)
+	}
+}
+
+// countingStore counts the lookups that reach it
+type countingStore struct {
+	DomainStore
+	gets int
+}
+
+func (s *countingStore) Get(name string) (DomainValue, bool) {
+	s.gets++
+	return s.DomainStore.Get(name)
+}
+
+func TestFilterInFrontOfStore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0.0.0.0 ads.example.com\n"))
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/filter_test.db")
+	b := New()
+	b.setupDB("/tmp/filter_test.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{{URI: srv.URL + "/ads", Enabled: true}}
+	b.downloadLists(nil)
+
+	h := b.active.Load()
+	store := &countingStore{DomainStore: h.store}
+	b.active.Store(&dbHandle{h.dbRef, store, h.kind})
+
+	if _, found := b.getDomain("ads.example.com."); !found || store.gets != 1 {
+		t.Errorf("expected ads.example.com. to be looked up in the store")
+	}
+
+	rejected := gMetrics.FilterRejected.Load()
+	for i := 0; i < 100; i++ {
+		b.getDomain(fmt.Sprintf("www%d.example.org.", i))
+	}
+	if store.gets > 10 || gMetrics.FilterRejected.Load()-rejected < 90 {
+		t.Errorf("expected the filter to answer most lookups, %d reached the store", store.gets-1)
+	}
+	if gMetrics.FilterBytes.Load() == 0 {
+		t.Errorf("expected the filter size in the metrics")
+	}
+
+	//domains of a list applied later pass the filter right away
+	b.active.Store(h)
+	b.UpdateDomains(map[string]DomainValue{"late.example.com.": {List_ids: []int{0}}})
+	if _, found := b.getDomain("late.example.com."); !found {
+		t.Errorf("expected late.example.com. to pass the filter")
+	}
+}
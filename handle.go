@@ -0,0 +1,95 @@
+package block
+
+import (
+	"sync/atomic"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// dbRef counts the users of an open db. It starts with the reference of
+// the published handle, lookups add theirs while they run, and the db is
+// closed when the last one is released.
+type dbRef struct {
+	db   *bolt.DB
+	refs atomic.Int64
+}
+
+func newDBRef(db *bolt.DB) *dbRef {
+	ref := &dbRef{db: db}
+	ref.refs.Store(1)
+	return ref
+}
+
+// tryAcquire adds a reference unless the db was already released for good
+func (r *dbRef) tryAcquire() bool {
+	for {
+		n := r.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if r.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (r *dbRef) release() {
+	if r.refs.Add(-1) == 0 {
+		r.db.Close()
+	}
+}
+
+// dbHandle is the published db with the store answering lookups from it.
+// Lookups load it without locks, list updates write through it while
+// holding Dmtx.RLock and swaps replace it while holding Dmtx.Lock.
+type dbHandle struct {
+	*dbRef
+	store DomainStore
+	kind  string
+}
+
+// acquire returns the active handle with a reference held for the caller,
+// nil before a db was set up
+func (b *Block) acquire() *dbHandle {
+	for {
+		h := b.active.Load()
+		if h == nil {
+			return nil
+		}
+		if h.tryAcquire() {
+			return h
+		}
+		//swapped out and closed in between, the next load sees the new one
+	}
+}
+
+// publish makes h the active handle, with Dmtx held. The db of the handle
+// it replaces is closed once the lookups still using it are done, unless h
+// shares it.
+func (b *Block) publish(h *dbHandle) {
+	old := b.active.Swap(h)
+	if old != nil && (h == nil || old.dbRef != h.dbRef) {
+		old.release()
+	}
+}
+
+// closeDB closes the active db once the lookups using it are done
+func (b *Block) closeDB() {
+	Dmtx.Lock()
+	defer Dmtx.Unlock()
+	b.publish(nil)
+}
+
+// db returns the active db, for callers holding Dmtx
+func (b *Block) db() *bolt.DB {
+	h := b.active.Load()
+	if h == nil {
+		return nil
+	}
+	return h.db
+}
+
+// domainStore returns the active store, for callers holding Dmtx
+func (b *Block) domainStore() DomainStore {
+	return b.active.Load().store
+}
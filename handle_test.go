@@ -0,0 +1,106 @@
+package block
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestHandleRefcount(t *testing.T) {
+	os.Remove("/tmp/handle_test.db")
+	b := New()
+	b.setupDB("/tmp/handle_test.db")
+	defer b.closeDB()
+
+	h := b.acquire()
+	old := h.db
+
+	os.Remove("/tmp/handle_test2.db")
+	b.setupDB("/tmp/handle_test2.db")
+	if b.active.Load() == h {
+		t.Fatalf("expected a new handle")
+	}
+	if err := old.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Errorf("expected the old db to stay open while in use: %v", err)
+	}
+
+	h.release()
+	if err := old.View(func(tx *bolt.Tx) error { return nil }); err != bolt.ErrDatabaseNotOpen {
+		t.Errorf("expected the old db to be closed after the last release, got %v", err)
+	}
+	if h.tryAcquire() {
+		t.Errorf("expected a released handle to stay released")
+	}
+}
+
+// TestLookupsDuringRefresh runs lookups while lists are refreshed, the db
+// is compacted and the store is switched. Run it with -race.
+func TestLookupsDuringRefresh(t *testing.T) {
+	var version atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := version.Load()
+		fmt.Fprintf(w, "0.0.0.0 always.example.com\n")
+		for i := int64(0); i < 200; i++ {
+			fmt.Fprintf(w, "0.0.0.0 host%d.v%d.example.com\n", i, v)
+		}
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/handle_race.db")
+	b := New()
+	b.setupDB("/tmp/handle_race.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{{URI: srv.URL + "/list", Enabled: true}}
+	b.downloadLists(nil)
+
+	var stop atomic.Bool
+	var misses, lookups atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; !stop.Load(); n++ {
+				returnIP, returnCNAME, hasPermit, categories := "", "", false, []string{}
+				if !b.blocked("192.168.2.10", "www.always.example.com.", &returnIP, &returnCNAME, &hasPermit, &categories) {
+					misses.Add(1)
+				}
+				b.getDomain(fmt.Sprintf("host%d.v%d.example.com.", n%200, n%3))
+				lookups.Add(1)
+			}
+		}(i)
+	}
+
+	for i := 0; i < 6; i++ {
+		version.Add(1)
+		b.downloadLists(nil)
+		if err := b.compactDb(); err != nil {
+			t.Errorf("compaction failed: %v", err)
+		}
+		if i%2 == 0 {
+			b.config.DomainStore = gMemoryStore
+		} else {
+			b.config.DomainStore = gBoltStore
+		}
+		b.selectStore()
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	if misses.Load() > 0 {
+		t.Errorf("%d of %d lookups missed a listed domain during refreshes", misses.Load(), lookups.Load())
+	}
+	if _, found := b.getDomain("host1.v6.example.com."); !found {
+		t.Errorf("expected the last version of the list")
+	}
+	if _, found := b.getDomain("host1.v5.example.com."); found {
+		t.Errorf("expected the previous version of the list to be gone")
+	}
+}
@@ -0,0 +1,165 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+var ErrListLimit = errors.New("block list exceeds limit")
+
+// ListLimits bounds what a download may produce. Zero means no limit.
+type ListLimits struct {
+	MaxBytes   int64 `json:",omitempty"` //bytes received, before decompression
+	MaxLines   int64 `json:",omitempty"` //lines read from the list
+	MaxDomains int64 `json:",omitempty"` //domains taken from the list
+}
+
+// applied to every list unless the list or the configuration sets its own
+var gDefaultListLimits = ListLimits{
+	MaxBytes:   256 * 1024 * 1024,
+	MaxLines:   10000000,
+	MaxDomains: 5000000,
+}
+
+// applied to the sum of all lists in a refresh
+var gDefaultTotalLimits = ListLimits{
+	MaxBytes:   1024 * 1024 * 1024,
+	MaxLines:   40000000,
+	MaxDomains: 10000000,
+}
+
+func limitError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrListLimit, fmt.Sprintf(format, args...))
+}
+
+// merge fills the unset limits of l from defaults, a nil l sets none
+func (l *ListLimits) merge(defaults ListLimits) ListLimits {
+	if l == nil {
+		return defaults
+	}
+	merged := *l
+	if merged.MaxBytes == 0 {
+		merged.MaxBytes = defaults.MaxBytes
+	}
+	if merged.MaxLines == 0 {
+		merged.MaxLines = defaults.MaxLines
+	}
+	if merged.MaxDomains == 0 {
+		merged.MaxDomains = defaults.MaxDomains
+	}
+	return merged
+}
+
+// listLimits resolves the limits for entry: the list's own, then the
+// configured ListLimits, then gDefaultListLimits.
+func (b *Block) listLimits(entry ListEntry) ListLimits {
+	return entry.Limits.merge(b.config.ListLimits.merge(gDefaultListLimits))
+}
+
+// downloadTotals tracks what all lists of one refresh used together. A nil
+// *downloadTotals does not limit anything.
+type downloadTotals struct {
+	limits  ListLimits
+	bytes   atomic.Int64
+	lines   atomic.Int64
+	domains atomic.Int64
+}
+
+func newDownloadTotals(limits *ListLimits) *downloadTotals {
+	return &downloadTotals{limits: limits.merge(gDefaultTotalLimits)}
+}
+
+func addTotal(counter *atomic.Int64, n int64, max int64, what string) error {
+	if counter.Add(n) > max && max > 0 {
+		return limitError("all lists together exceed %d %s", max, what)
+	}
+	return nil
+}
+
+func (t *downloadTotals) addBytes(n int64) error {
+	if t == nil {
+		return nil
+	}
+	return addTotal(&t.bytes, n, t.limits.MaxBytes, "bytes")
+}
+
+func (t *downloadTotals) addLine() error {
+	if t == nil {
+		return nil
+	}
+	return addTotal(&t.lines, 1, t.limits.MaxLines, "lines")
+}
+
+func (t *downloadTotals) addDomain() error {
+	if t == nil {
+		return nil
+	}
+	return addTotal(&t.domains, 1, t.limits.MaxDomains, "domains")
+}
+
+// remove takes back what a failed download added
+func (t *downloadTotals) remove(bytes int64, lines int64, domains int64) {
+	if t == nil {
+		return
+	}
+	t.bytes.Add(-bytes)
+	t.lines.Add(-lines)
+	t.domains.Add(-domains)
+}
+
+// listCounter enforces the limits of a single list and the totals of the
+// refresh it belongs to. Everything it counts is added to the totals, so a
+// failed download can release it again.
+type listCounter struct {
+	limits  ListLimits
+	totals  *downloadTotals
+	bytes   int64
+	lines   int64
+	domains int64
+}
+
+func (c *listCounter) addLine() error {
+	c.lines++
+	terr := c.totals.addLine()
+	if c.limits.MaxLines > 0 && c.lines > c.limits.MaxLines {
+		return limitError("more than %d lines", c.limits.MaxLines)
+	}
+	return terr
+}
+
+func (c *listCounter) addDomain() error {
+	c.domains++
+	terr := c.totals.addDomain()
+	if c.limits.MaxDomains > 0 && c.domains > c.limits.MaxDomains {
+		return limitError("more than %d domains", c.limits.MaxDomains)
+	}
+	return terr
+}
+
+// release takes what was counted back out of the totals
+func (c *listCounter) release() {
+	c.totals.remove(c.bytes, c.lines, c.domains)
+	c.bytes, c.lines, c.domains = 0, 0, 0
+}
+
+// countedBody wraps a response body and fails once the list or the
+// refresh received too many bytes.
+type countedBody struct {
+	io.ReadCloser
+	counter *listCounter
+}
+
+func (c *countedBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.counter.bytes += int64(n)
+	terr := c.counter.totals.addBytes(int64(n))
+	if c.counter.limits.MaxBytes > 0 && c.counter.bytes > c.counter.limits.MaxBytes {
+		return n, limitError("more than %d bytes", c.counter.limits.MaxBytes)
+	}
+	if terr != nil {
+		return n, terr
+	}
+	return n, err
+}
@@ -0,0 +1,147 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func manyDomains(prefix string, n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "0.0.0.0 %s%d.example.com\n", prefix, i)
+	}
+	return sb.String()
+}
+
+func TestListLimits(t *testing.T) {
+	list := manyDomains("d", 100)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			//no Content-Length, counted while reading
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(list))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		limits ListLimits
+		ok     bool
+	}{
+		{"within limits", "/hosts", ListLimits{MaxBytes: 10000, MaxLines: 100, MaxDomains: 100}, true},
+		{"too many lines", "/hosts", ListLimits{MaxLines: 99}, false},
+		{"too many domains", "/hosts", ListLimits{MaxDomains: 99}, false},
+		{"content length too large", "/hosts", ListLimits{MaxBytes: 100}, false},
+		{"body too large", "/chunked", ListLimits{MaxBytes: 100}, false},
+	}
+
+	for _, test := range tests {
+		os.Remove("/tmp/limits_test.db")
+		db := BoltOpen("/tmp/limits_test.db")
+
+		b := New()
+		err := b.dbStagingDownload(db, ListEntry{URI: srv.URL + test.path, Limits: &test.limits}, 0)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if !test.ok && !errors.Is(err, ErrListLimit) {
+			t.Errorf("%s: expected ErrListLimit, got %v", test.name, err)
+		}
+		db.Close()
+	}
+}
+
+func TestTotalLimits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(manyDomains(r.URL.Path[1:], 60)))
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/limits_test.db")
+	db := BoltOpen("/tmp/limits_test.db")
+	defer db.Close()
+
+	b := New()
+	b.totals = newDownloadTotals(&ListLimits{MaxDomains: 100})
+
+	err := b.dbStagingDownload(db, ListEntry{URI: srv.URL + "/a"}, 0)
+	if err != nil {
+		t.Fatalf("first list should fit, got %v", err)
+	}
+
+	err = b.dbStagingDownload(db, ListEntry{URI: srv.URL + "/b"}, 1)
+	if !errors.Is(err, ErrListLimit) {
+		t.Errorf("expected second list to break the total limit, got %v", err)
+	}
+}
+
+func TestFailedMirrorTotals(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(manyDomains(r.URL.Path[1:], 60)))
+		if r.URL.Path == "/broken" {
+			//a line past the scanner buffer fails the download
+			w.Write([]byte(strings.Repeat("x", 100000)))
+		}
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/limits_test.db")
+	db := BoltOpen("/tmp/limits_test.db")
+	defer db.Close()
+
+	b := New()
+	b.totals = newDownloadTotals(&ListLimits{MaxDomains: 100})
+
+	err := b.dbStagingDownload(db, ListEntry{URI: srv.URL + "/broken", Mirrors: []string{srv.URL + "/mirror"}}, 0)
+	if err != nil {
+		t.Fatalf("expected the mirror to fit the totals, got %v", err)
+	}
+	if b.totals.domains.Load() != 60 {
+		t.Errorf("expected only the mirror to count, got %d domains", b.totals.domains.Load())
+	}
+}
+
+func TestLimitKeepsPreviousData(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(manyDomains("new", 50)))
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/limits_live.db")
+	b := New()
+	b.setupDB("/tmp/limits_live.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+
+	storeBatch(b.db(), []string{"old.example.com."}, 1, 0)
+
+	b.config.BlockLists = []ListEntry{
+		{URI: srv.URL + "/big", Enabled: true, Limits: &ListLimits{MaxDomains: 10}},
+		{URI: srv.URL + "/fine", Enabled: true},
+	}
+
+	b.downloadLists(nil)
+
+	value, found := b.getDomain("old.example.com.")
+	if !found || len(value.List_ids) != 1 || value.List_ids[0] != 0 {
+		t.Errorf("expected the previous copy of the list to be kept, got %v", value.List_ids)
+	}
+
+	value, _ = b.getDomain("new0.example.com.")
+	if len(value.List_ids) != 1 || value.List_ids[0] != 1 {
+		t.Errorf("expected partial data of the failed list to be dropped, got %v", value.List_ids)
+	}
+
+	status := getListStatus(srv.URL + "/big")
+	if !strings.Contains(status.Error, ErrListLimit.Error()) {
+		t.Errorf("expected limit error in list status, got %q", status.Error)
+	}
+}
@@ -0,0 +1,355 @@
+package block
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// every list has a bucket below gListsBucket, named by its ID, holding the
+// domains of that list. It lets a single list be diffed and patched in place.
+var gListsBucket = "lists"
+
+// operations per write transaction when patching lists
+var gListChunk = 16384
+
+func listBucketName(list_id int) []byte {
+	return []byte(strconv.Itoa(list_id))
+}
+
+func listBucket(tx *bolt.Tx, list_id int) *bolt.Bucket {
+	lists := tx.Bucket([]byte(gListsBucket))
+	if lists == nil {
+		return nil
+	}
+	return lists.Bucket(listBucketName(list_id))
+}
+
+func createListBucket(tx *bolt.Tx, list_id int) (*bolt.Bucket, error) {
+	lists, err := tx.CreateBucketIfNotExists([]byte(gListsBucket))
+	if err != nil {
+		return nil, err
+	}
+	return lists.CreateBucketIfNotExists(listBucketName(list_id))
+}
+
+// storedListIDs returns the IDs of all lists db has domains for
+func storedListIDs(db *bolt.DB) ([]int, error) {
+	ids := []int{}
+	err := db.View(func(tx *bolt.Tx) error {
+		lists := tx.Bucket([]byte(gListsBucket))
+		if lists == nil {
+			return nil
+		}
+		return lists.ForEachBucket(func(k []byte) error {
+			id, err := strconv.Atoi(string(k))
+			if err == nil {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
+
+func listDomainCount(db *bolt.DB, list_id int) int64 {
+	keyN := int64(0)
+	db.View(func(tx *bolt.Tx) error {
+		bucket := listBucket(tx, list_id)
+		if bucket != nil {
+			keyN = int64(bucket.Stats().KeyN)
+		}
+		return nil
+	})
+	return keyN
+}
+
+// storeListBatch records domains[:idx] as members of list_id, without
+// touching the domains bucket. Downloads are staged this way.
+func storeListBatch(db *bolt.DB, domains []string, idx int, list_id int) error {
+	return db.Batch(func(tx *bolt.Tx) error {
+		bucket, err := createListBucket(tx, list_id)
+		if err != nil {
+			return err
+		}
+		for _, domain := range domains[:idx] {
+			err = bucket.Put([]byte(domain), []byte{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// clearList drops the list bucket of list_id
+func clearList(db *bolt.DB, list_id int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		lists := tx.Bucket([]byte(gListsBucket))
+		if lists == nil || lists.Bucket(listBucketName(list_id)) == nil {
+			return nil
+		}
+		return lists.DeleteBucket(listBucketName(list_id))
+	})
+}
+
+func addListID(bucket *bolt.Bucket, domain []byte, list_id int) error {
+	item := BucketItem{Key: string(domain)}
+	v := bucket.Get(domain)
+	if v != nil {
+		item.DecodeValue(v)
+		if slices.Contains(item.Value.List_ids, list_id) {
+			return nil
+		}
+	}
+
+	item.Value.List_ids = append(item.Value.List_ids, list_id)
+	slices.Sort(item.Value.List_ids)
+
+	itemValue, err := item.EncodeValue()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(domain, itemValue)
+}
+
+func removeListID(bucket *bolt.Bucket, domain []byte, list_id int) error {
+	v := bucket.Get(domain)
+	if v == nil {
+		return nil
+	}
+
+	item := BucketItem{Key: string(domain)}
+	item.DecodeValue(v)
+	item.Value.List_ids = slices.DeleteFunc(item.Value.List_ids, func(id int) bool { return id == list_id })
+	if len(item.Value.List_ids) == 0 {
+		return bucket.Delete(domain)
+	}
+
+	itemValue, err := item.EncodeValue()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(domain, itemValue)
+}
+
+// patchList adds and removes domains of list_id in db
+func patchList(db *bolt.DB, list_id int, adds [][]byte, dels [][]byte) error {
+	if len(adds) == 0 && len(dels) == 0 {
+		return nil
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		domains, err := tx.CreateBucketIfNotExists([]byte(gDomainBucket))
+		if err != nil {
+			return err
+		}
+		list, err := createListBucket(tx, list_id)
+		if err != nil {
+			return err
+		}
+
+		for _, domain := range adds {
+			if err = addListID(domains, domain, list_id); err != nil {
+				return err
+			}
+			if err = list.Put(domain, []byte{}); err != nil {
+				return err
+			}
+		}
+
+		for _, domain := range dels {
+			if err = removeListID(domains, domain, list_id); err != nil {
+				return err
+			}
+			if err = list.Delete(domain); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+// seekAfter positions c on the first key after key, or the first key when
+// key is nil
+func seekAfter(c *bolt.Cursor, key []byte) ([]byte, []byte) {
+	if c == nil {
+		return nil, nil
+	}
+	if key == nil {
+		return c.First()
+	}
+	k, v := c.Seek(key)
+	if k != nil && bytes.Equal(k, key) {
+		k, v = c.Next()
+	}
+	return k, v
+}
+
+func nextKey(c *bolt.Cursor) []byte {
+	k, _ := c.Next()
+	return k
+}
+
+// applyList makes list_id in live match list_id in staging. Both list buckets
+// are sorted, so walking them side by side yields the domains to add and to
+// remove. The walk and the patch go in chunks of gListChunk so no
+// transaction grows with the size of the list. reload, if set, is handed
+// the domains of every patched chunk.
+func applyList(live *bolt.DB, staging *bolt.DB, list_id int, reload func([][]byte) error) (int64, int64, error) {
+	added, removed := int64(0), int64(0)
+	var after []byte
+
+	for {
+		adds, dels := [][]byte{}, [][]byte{}
+		done := false
+
+		err := staging.View(func(stx *bolt.Tx) error {
+			return live.View(func(ltx *bolt.Tx) error {
+				var sc, lc *bolt.Cursor
+				if bucket := listBucket(stx, list_id); bucket != nil {
+					sc = bucket.Cursor()
+				}
+				if bucket := listBucket(ltx, list_id); bucket != nil {
+					lc = bucket.Cursor()
+				}
+
+				sk, _ := seekAfter(sc, after)
+				lk, _ := seekAfter(lc, after)
+
+				for n := 0; n < gListChunk; n++ {
+					if sk == nil && lk == nil {
+						done = true
+						return nil
+					}
+
+					cmp := 0
+					if sk == nil {
+						cmp = 1
+					} else if lk == nil {
+						cmp = -1
+					} else {
+						cmp = bytes.Compare(sk, lk)
+					}
+
+					//keys are only valid during the transaction, copy them
+					if cmp < 0 {
+						after = bytes.Clone(sk)
+						adds = append(adds, after)
+						sk = nextKey(sc)
+					} else if cmp > 0 {
+						after = bytes.Clone(lk)
+						dels = append(dels, after)
+						lk = nextKey(lc)
+					} else {
+						after = bytes.Clone(sk)
+						sk = nextKey(sc)
+						lk = nextKey(lc)
+					}
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return added, removed, err
+		}
+
+		err = patchList(live, list_id, adds, dels)
+		if err == nil && reload != nil {
+			err = reload(append(adds, dels...))
+		}
+		if err != nil {
+			return added, removed, err
+		}
+		added += int64(len(adds))
+		removed += int64(len(dels))
+
+		if done {
+			return added, removed, nil
+		}
+	}
+}
+
+// dropList removes list_id from db altogether, handing the domains of every
+// patched chunk to reload if set
+func dropList(db *bolt.DB, list_id int, reload func([][]byte) error) (int64, error) {
+	removed := int64(0)
+
+	for {
+		dels := [][]byte{}
+		err := db.View(func(tx *bolt.Tx) error {
+			bucket := listBucket(tx, list_id)
+			if bucket == nil {
+				return nil
+			}
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil && len(dels) < gListChunk; k, _ = c.Next() {
+				dels = append(dels, bytes.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+
+		if len(dels) == 0 {
+			err = db.Update(func(tx *bolt.Tx) error {
+				return deleteListMeta(tx, list_id)
+			})
+			if err != nil {
+				return removed, err
+			}
+			return removed, clearList(db, list_id)
+		}
+
+		err = patchList(db, list_id, nil, dels)
+		if err == nil && reload != nil {
+			err = reload(dels)
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed += int64(len(dels))
+	}
+}
+
+// migrateListBuckets builds the list buckets for a db from before they
+// existed, using the list IDs stored with every domain.
+func migrateListBuckets(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(gListsBucket)) != nil {
+			return nil
+		}
+		_, err := tx.CreateBucket([]byte(gListsBucket))
+		if err != nil {
+			return err
+		}
+
+		domains := tx.Bucket([]byte(gDomainBucket))
+		if domains == nil {
+			return nil
+		}
+
+		return domains.ForEach(func(k, v []byte) error {
+			item := BucketItem{}
+			if item.DecodeValue(v) != nil {
+				return nil
+			}
+			for _, list_id := range item.Value.List_ids {
+				bucket, err := createListBucket(tx, list_id)
+				if err != nil {
+					return err
+				}
+				err = bucket.Put(k, []byte{})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
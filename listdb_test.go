@@ -0,0 +1,278 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func listHas(db *bolt.DB, list_id int, domain string) bool {
+	found := false
+	db.View(func(tx *bolt.Tx) error {
+		bucket := listBucket(tx, list_id)
+		found = bucket != nil && bucket.Get([]byte(domain)) != nil
+		return nil
+	})
+	return found
+}
+
+func TestApplyList(t *testing.T) {
+	chunk := gListChunk
+	gListChunk = 3
+	defer func() { gListChunk = chunk }()
+
+	os.Remove("/tmp/listdb_live.db")
+	os.Remove("/tmp/listdb_staging.db")
+	live := BoltOpen("/tmp/listdb_live.db")
+	defer live.Close()
+	staging := BoltOpen("/tmp/listdb_staging.db")
+	defer staging.Close()
+
+	storeBatch(live, []string{"a.com.", "b.com.", "c.com.", "d.com.", "shared.com."}, 5, 1)
+	storeBatch(live, []string{"shared.com.", "other.com."}, 2, 2)
+
+	next := []string{"b.com.", "d.com.", "e.com.", "f.com.", "g.com.", "h.com."}
+	storeListBatch(staging, next, len(next), 1)
+
+	added, removed, err := applyList(live, staging, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 4 || removed != 3 {
+		t.Errorf("expected 4 added and 3 removed, got %d and %d", added, removed)
+	}
+
+	for _, domain := range next {
+		if !listHas(live, 1, domain) {
+			t.Errorf("missing %s in list", domain)
+		}
+		err, item := getItem(live, gDomainBucket, domain)
+		if err != nil || len(item.Value.List_ids) != 1 || item.Value.List_ids[0] != 1 {
+			t.Errorf("unexpected lists for %s: %v", domain, item.Value.List_ids)
+		}
+	}
+
+	for _, domain := range []string{"a.com.", "c.com."} {
+		if err, _ := getItem(live, gDomainBucket, domain); err == nil {
+			t.Errorf("expected %s to be removed", domain)
+		}
+	}
+
+	err, item := getItem(live, gDomainBucket, "shared.com.")
+	if err != nil || len(item.Value.List_ids) != 1 || item.Value.List_ids[0] != 2 {
+		t.Errorf("expected shared.com. to stay in list 2 only, got %v", item.Value.List_ids)
+	}
+
+	//applying the same list again changes nothing
+	added, removed, err = applyList(live, staging, 1, nil)
+	if err != nil || added != 0 || removed != 0 {
+		t.Errorf("expected no changes, got %d added %d removed %v", added, removed, err)
+	}
+
+	removed, err = dropList(live, 1, nil)
+	if err != nil || removed != int64(len(next)) {
+		t.Errorf("expected %d domains dropped, got %d %v", len(next), removed, err)
+	}
+	if getCount(live, gDomainBucket) != 2 {
+		t.Errorf("expected only list 2 to remain, got %d domains", getCount(live, gDomainBucket))
+	}
+}
+
+func TestMigrateListBuckets(t *testing.T) {
+	os.Remove("/tmp/listdb_migrate.db")
+	db := BoltOpen("/tmp/listdb_migrate.db")
+
+	//a db from before list buckets only has the domains bucket
+	db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(gDomainBucket))
+		for domain, ids := range map[string][]int{"a.com.": {0}, "b.com.": {0, 1}} {
+			item := BucketItem{domain, DomainValue{List_ids: ids}}
+			value, _ := item.EncodeValue()
+			bucket.Put(item.EncodeKey(), value)
+		}
+		return nil
+	})
+	db.Close()
+
+	b := New()
+	b.setupDB("/tmp/listdb_migrate.db")
+	defer b.closeDB()
+
+	if listDomainCount(b.db(), 0) != 2 || listDomainCount(b.db(), 1) != 1 || !listHas(b.db(), 1, "b.com.") {
+		t.Errorf("list buckets were not built from the domains")
+	}
+}
+
+func TestAssignListIDs(t *testing.T) {
+	config := SPRBlockConfig{BlockLists: []ListEntry{{URI: "a"}, {URI: "b"}, {URI: "c"}}}
+	config.assignListIDs()
+	for i, entry := range config.BlockLists {
+		if entry.ID != i {
+			t.Errorf("expected legacy list %s to get id %d, got %d", entry.URI, i, entry.ID)
+		}
+	}
+
+	config.BlockLists = config.BlockLists[:1]
+	config.BlockLists = append(config.BlockLists, ListEntry{URI: "d"})
+	config.assignListIDs()
+	if config.BlockLists[1].ID != 3 {
+		t.Errorf("expected a new id for d, got %d", config.BlockLists[1].ID)
+	}
+}
+
+// a config from before list ids is saved unchanged but for the ids given out
+func TestConfigRoundTrip(t *testing.T) {
+	fixture, err := os.ReadFile("./test_data/block_rules.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	CONFIG_PATH = t.TempDir() + "/block_rules.json"
+	os.WriteFile(CONFIG_PATH, fixture, 0644)
+
+	b := New()
+	b.loadSPRConfig()
+	b.saveConfig()
+	saved, err := os.ReadFile(CONFIG_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := map[string]interface{}{}
+	after := map[string]interface{}{}
+	json.Unmarshal(fixture, &before)
+	json.Unmarshal(saved, &after)
+
+	lists, _ := after["BlockLists"].([]interface{})
+	for i, list := range lists {
+		entry := list.(map[string]interface{})
+		if entry["ID"] != float64(i) {
+			t.Errorf("expected list %d to keep its index as id, got %v", i, entry["ID"])
+		}
+		delete(entry, "ID")
+	}
+	if after["NextListID"] != float64(len(lists)) {
+		t.Errorf("expected NextListID %d, got %v", len(lists), after["NextListID"])
+	}
+	delete(after, "NextListID")
+
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("expected the config to round-trip, got %s", saved)
+	}
+}
+
+func TestIncrementalListUpdates(t *testing.T) {
+	CONFIG_PATH = t.TempDir() + "/block_rules.json"
+
+	var mtx sync.Mutex
+	requests := map[string]int{}
+	contents := map[string]string{
+		"/one": "0.0.0.0 one.example.com\n0.0.0.0 shared.example.com\n",
+		"/two": "0.0.0.0 two.example.com\n0.0.0.0 shared.example.com\n",
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests[r.URL.Path]++
+		w.Write([]byte(contents[r.URL.Path]))
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/incremental.db")
+	b := New()
+	b.setupDB("/tmp/incremental.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{
+		{URI: srv.URL + "/one", Enabled: true},
+		{URI: srv.URL + "/two", Enabled: true},
+	}
+
+	b.downloadLists(nil)
+	if status := getListStatus(srv.URL + "/one"); status.Domains != 2 || status.Added != 2 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	mtx.Lock()
+	contents["/one"] = "0.0.0.0 shared.example.com\n0.0.0.0 new.example.com\n0.0.0.0 newer.example.com\n"
+	mtx.Unlock()
+
+	b.downloadLists(nil)
+	status := getListStatus(srv.URL + "/one")
+	if status.Domains != 3 || status.Added != 2 || status.Removed != 1 {
+		t.Errorf("expected 2 added and 1 removed, got %+v", status)
+	}
+	if status := getListStatus(srv.URL + "/two"); status.Added != 0 || status.Removed != 0 {
+		t.Errorf("expected list two to be unchanged, got %+v", status)
+	}
+
+	waitFor := func(what string, cond func() bool) {
+		for i := 0; i < 200 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !cond() {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+
+	send := func(method string, entry ListEntry) {
+		payload, _ := json.Marshal(entry)
+		req, _ := http.NewRequest(method, "/blocklists", bytes.NewBuffer(payload))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(b.modifyBlockLists).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s failed: %d %s", method, rr.Code, rr.Body.String())
+		}
+	}
+
+	blocked := func(name string) bool {
+		Dmtx.RLock()
+		defer Dmtx.RUnlock()
+		_, _, _, exists := b.getDomainInfo(name, &lookupTrace{})
+		return exists
+	}
+
+	//toggles apply at once and without the network
+	srv.Close()
+
+	send("PUT", ListEntry{URI: srv.URL + "/two", Enabled: false})
+	if blocked("two.example.com.") || !blocked("shared.example.com.") {
+		t.Errorf("expected only list one to apply after disabling list two")
+	}
+	if !listHas(b.db(), 1, "two.example.com.") {
+		t.Errorf("expected the disabled list to stay stored")
+	}
+
+	send("PUT", ListEntry{URI: srv.URL + "/two", Enabled: true, Category: "ads"})
+	if !blocked("two.example.com.") {
+		t.Errorf("expected list two to apply again")
+	}
+
+	send("DELETE", ListEntry{URI: srv.URL + "/one"})
+	if blocked("new.example.com.") {
+		t.Errorf("expected the deleted list not to apply")
+	}
+	waitFor("list one to be collected", func() bool {
+		Dmtx.RLock()
+		defer Dmtx.RUnlock()
+		return listDomainCount(b.db(), 0) == 0
+	})
+
+	//wait for the handlers to finish before counting
+	DLmtx.Lock()
+	DLmtx.Unlock()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if requests["/one"] != 2 || requests["/two"] != 2 {
+		t.Errorf("expected no downloads for toggles, got %v", requests)
+	}
+}
@@ -0,0 +1,263 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// the meta bucket records the schema version of the db, when it was created
+// and last updated, and a fingerprint of every list it holds
+var gSchemaVersion = 2
+
+var ErrSchemaUnsupported = errors.New("unsupported database schema")
+
+type migration struct {
+	version int //schema version after the migration
+	name    string
+	run     func(db *bolt.DB) error
+}
+
+// migrations run in order on databases with an older schema version. They
+// have to be safe to run again, as a crash before the version is written
+// repeats them on the next start.
+var gMigrations = []migration{
+	{1, "per list buckets", migrateListBuckets},
+	{2, "compact value encoding", migrateValueEncoding},
+}
+
+// ListMeta describes the copy of a list in the db
+type ListMeta struct {
+	ID          int
+	URI         string
+	Source      string //the URI or mirror the copy came from
+	Fingerprint string //sha256 of the list as downloaded, after decompression
+	SHA256      string `json:",omitempty"` //pins the copy was verified against
+	PublicKey   string `json:",omitempty"`
+	Domains     int64
+	Updated     int64 //unix time the copy was applied
+}
+
+// DBMeta is the content of the meta bucket
+type DBMeta struct {
+	SchemaVersion int
+	Created       int64
+	Updated       int64
+	Fingerprint   string //over the fingerprints of all lists
+	Lists         []ListMeta
+}
+
+var gMetaListsBucket = "lists"
+
+func putMetaInt(meta *bolt.Bucket, key string, value int64) error {
+	return meta.Put([]byte(key), []byte(strconv.FormatInt(value, 10)))
+}
+
+func getMetaInt(meta *bolt.Bucket, key string) (int64, bool) {
+	v := meta.Get([]byte(key))
+	if v == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(string(v), 10, 64)
+	return value, err == nil
+}
+
+// schemaVersion returns the schema version of db, 0 for a db from before
+// versions were recorded. An unreadable version is an error.
+func schemaVersion(db *bolt.DB) (int, error) {
+	version := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(gMetaBucket))
+		if meta == nil || meta.Get([]byte("schema_version")) == nil {
+			return nil
+		}
+		v, ok := getMetaInt(meta, "schema_version")
+		if !ok {
+			return fmt.Errorf("%w: unreadable version %q", ErrSchemaUnsupported, meta.Get([]byte("schema_version")))
+		}
+		version = int(v)
+		return nil
+	})
+	return version, err
+}
+
+// migrateDB brings db to gSchemaVersion. A db with a newer schema is left
+// alone and ErrSchemaUnsupported returned.
+func migrateDB(db *bolt.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > gSchemaVersion {
+		return fmt.Errorf("%w: version %d is newer than %d", ErrSchemaUnsupported, version, gSchemaVersion)
+	}
+	//a new db has nothing to migrate, the steps only record the version
+	upgrade := version > 0 || !isNewDB(db)
+
+	for _, m := range gMigrations {
+		if m.version <= version {
+			continue
+		}
+		start := time.Now()
+		err = m.run(db)
+		if err != nil {
+			return fmt.Errorf("migration to version %d (%s) failed: %w", m.version, m.name, err)
+		}
+		err = setSchemaVersion(db, m.version)
+		if err != nil {
+			return err
+		}
+		if upgrade {
+			log.Infof("Migrated database to version %d (%s) in %s", m.version, m.name, time.Since(start).Round(time.Millisecond))
+		}
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(gMetaBucket))
+		if err != nil {
+			return err
+		}
+		if _, ok := getMetaInt(meta, "created"); !ok {
+			err = putMetaInt(meta, "created", time.Now().Unix())
+		}
+		if err == nil {
+			err = putMetaInt(meta, "schema_version", int64(gSchemaVersion))
+		}
+		return err
+	})
+}
+
+// isNewDB reports if db holds no meta and no domains yet
+func isNewDB(db *bolt.DB) bool {
+	empty := true
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(gMetaBucket)) != nil {
+			empty = false
+			return nil
+		}
+		bucket := tx.Bucket([]byte(gDomainBucket))
+		if bucket != nil {
+			k, _ := bucket.Cursor().First()
+			empty = k == nil
+		}
+		return nil
+	})
+	return empty
+}
+
+func setSchemaVersion(db *bolt.DB, version int) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(gMetaBucket))
+		if err != nil {
+			return err
+		}
+		return putMetaInt(meta, "schema_version", int64(version))
+	})
+	if err == nil {
+		db.Sync()
+	}
+	return err
+}
+
+// setListMeta records the copy of a list just applied to db
+func setListMeta(db *bolt.DB, list ListMeta) error {
+	list.Updated = time.Now().Unix()
+	value, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(gMetaBucket))
+		if err != nil {
+			return err
+		}
+		lists, err := meta.CreateBucketIfNotExists([]byte(gMetaListsBucket))
+		if err != nil {
+			return err
+		}
+		err = putMetaInt(meta, "updated", list.Updated)
+		if err != nil {
+			return err
+		}
+		return lists.Put(listBucketName(list.ID), value)
+	})
+}
+
+func deleteListMeta(tx *bolt.Tx, list_id int) error {
+	meta := tx.Bucket([]byte(gMetaBucket))
+	if meta == nil {
+		return nil
+	}
+	lists := meta.Bucket([]byte(gMetaListsBucket))
+	if lists == nil {
+		return nil
+	}
+	return lists.Delete(listBucketName(list_id))
+}
+
+func getDBMeta(db *bolt.DB) (DBMeta, error) {
+	info := DBMeta{}
+	err := db.View(func(tx *bolt.Tx) error {
+		info = readDBMeta(tx)
+		return nil
+	})
+	return info, err
+}
+
+// readDBMeta reads the meta bucket within tx
+func readDBMeta(tx *bolt.Tx) DBMeta {
+	info := DBMeta{Lists: []ListMeta{}}
+	meta := tx.Bucket([]byte(gMetaBucket))
+	if meta != nil {
+		version, _ := getMetaInt(meta, "schema_version")
+		info.SchemaVersion = int(version)
+		info.Created, _ = getMetaInt(meta, "created")
+		info.Updated, _ = getMetaInt(meta, "updated")
+
+		if lists := meta.Bucket([]byte(gMetaListsBucket)); lists != nil {
+			lists.ForEach(func(k, v []byte) error {
+				list := ListMeta{}
+				if json.Unmarshal(v, &list) == nil {
+					info.Lists = append(info.Lists, list)
+				}
+				return nil
+			})
+		}
+	}
+
+	slices.SortFunc(info.Lists, func(a, b ListMeta) int { return a.ID - b.ID })
+	h := sha256.New()
+	for _, list := range info.Lists {
+		fmt.Fprintf(h, "%d %s %s\n", list.ID, list.URI, list.Fingerprint)
+	}
+	info.Fingerprint = hex.EncodeToString(h.Sum(nil))
+
+	return info
+}
+
+func (b *Block) showDBMeta(w http.ResponseWriter, r *http.Request) {
+	h := b.acquire()
+	if h == nil {
+		http.Error(w, "database not ready", 400)
+		return
+	}
+	info, err := getDBMeta(h.db)
+	h.release()
+
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
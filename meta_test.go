@@ -0,0 +1,122 @@
+package block
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	os.Remove("/tmp/meta_test.db")
+	b := New()
+	b.setupDB("/tmp/meta_test.db")
+
+	info, err := getDBMeta(b.db())
+	if err != nil || info.SchemaVersion != gSchemaVersion || info.Created == 0 {
+		t.Fatalf("expected a new db at version %d, got %+v %v", gSchemaVersion, info, err)
+	}
+	b.closeDB()
+
+	//a legacy db without a version is migrated
+	os.Remove("/tmp/meta_test.db")
+	db := BoltOpen("/tmp/meta_test.db")
+	putJSONValues(db, 10)
+	db.Close()
+
+	b.setupDB("/tmp/meta_test.db")
+	if version, _ := schemaVersion(b.db()); version != gSchemaVersion {
+		t.Errorf("expected legacy db to be migrated, at version %d", version)
+	}
+	if _, found := b.getDomain("host1.example.com."); !found {
+		t.Errorf("expected host1.example.com. to survive the migration")
+	}
+	b.closeDB()
+}
+
+func TestUnsupportedSchema(t *testing.T) {
+	for _, version := range []string{"99", "garbage"} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "block.db")
+
+		db := BoltOpen(path)
+		putJSONValues(db, 10)
+		db.Update(func(tx *bolt.Tx) error {
+			meta, _ := tx.CreateBucketIfNotExists([]byte(gMetaBucket))
+			return meta.Put([]byte("schema_version"), []byte(version))
+		})
+		db.Close()
+
+		b := New()
+		b.setupDB(path)
+		if _, found := b.getDomain("host1.example.com."); found {
+			t.Errorf("version %s: expected a fresh db", version)
+		}
+		if v, _ := schemaVersion(b.db()); v != gSchemaVersion {
+			t.Errorf("version %s: expected the fresh db at version %d, got %d", version, gSchemaVersion, v)
+		}
+		b.closeDB()
+
+		aside, _ := filepath.Glob(path + ".unsupported-*")
+		if len(aside) != 1 {
+			t.Errorf("version %s: expected the old db to be moved aside, got %v", version, aside)
+		}
+	}
+}
+
+func TestListMeta(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0.0.0.0 " + r.URL.Path[1:] + ".example.com\n"))
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/list_meta_test.db")
+	b := New()
+	b.setupDB("/tmp/list_meta_test.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{
+		{URI: srv.URL + "/ads", Enabled: true},
+		{URI: srv.URL + "/trackers", Enabled: true},
+	}
+	b.downloadLists(nil)
+
+	info, _ := getDBMeta(b.db())
+	if len(info.Lists) != 2 || info.Lists[0].Domains != 1 || info.Lists[1].URI != srv.URL+"/trackers" {
+		t.Fatalf("unexpected list meta %+v", info.Lists)
+	}
+	if len(info.Lists[0].Fingerprint) != 64 || info.Lists[0].Fingerprint == info.Lists[1].Fingerprint {
+		t.Errorf("expected a fingerprint per list, got %+v", info.Lists)
+	}
+	fingerprint := info.Fingerprint
+
+	//the same content leaves the fingerprint alone
+	b.downloadLists(nil)
+	info, _ = getDBMeta(b.db())
+	if info.Fingerprint != fingerprint {
+		t.Errorf("expected the fingerprint to stay the same")
+	}
+
+	b.config.BlockLists = b.config.BlockLists[1:]
+	b.collectGarbage()
+	info, _ = getDBMeta(b.db())
+	ids := []int{}
+	for _, list := range info.Lists {
+		ids = append(ids, list.ID)
+	}
+	if !slices.Equal(ids, []int{1}) {
+		t.Errorf("expected only the meta of list 1 after GC, got %v", ids)
+	}
+
+	rr := httptest.NewRecorder()
+	b.showDBMeta(rr, httptest.NewRequest("GET", "/db/meta", nil))
+	served := DBMeta{}
+	if err := json.NewDecoder(rr.Body).Decode(&served); err != nil || served.Fingerprint != info.Fingerprint {
+		t.Errorf("unexpected /db/meta response %+v %v", served, err)
+	}
+}
@@ -1,18 +1,296 @@
 package block
 
 import (
+	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
-
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
 )
 
-var blockCount = prometheus.NewCounterVec(prometheus.CounterOpts{
-	Namespace: plugin.Namespace,
-	Subsystem: "block",
-	Name:      "count_total",
-	Help:      "Counter of blocked names.",
-}, []string{"server"})
+// Variables declared for monitoring.
+var (
+	blockCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "block",
+		Name:      "count_total",
+		Help:      "Counter of blocked names.",
+	}, []string{"server"})
+
+	decisionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "block",
+		Name:      "decisions_total",
+		Help:      "Counter of queries by what decided them.",
+	}, []string{"server", "action"})
+
+	categoryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "block",
+		Name:      "categories_total",
+		Help:      "Counter of queries for names in a list category, by what decided them.",
+	}, []string{"server", "action", "category"})
+
+	lookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "block",
+		Name:      "lookup_duration_seconds",
+		Help:      "Histogram of the time to decide whether a name is blocked.",
+		Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 10), //1µs to 0.26s
+	}, []string{"server"})
+
+	listDomains = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "block",
+		Name:      "list_domains",
+		Help:      "Domains stored for a block list.",
+	}, []string{"list_id"})
+
+	listUpdated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "block",
+		Name:      "list_last_success_timestamp_seconds",
+		Help:      "Unix time a block list was last downloaded and applied.",
+	}, []string{"list_id"})
+
+	listErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "block",
+		Name:      "list_errors_total",
+		Help:      "Counter of failed block list downloads.",
+	}, []string{"list_id"})
+
+	lastRefresh = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "block",
+		Name:      "last_refresh_timestamp_seconds",
+		Help:      "Unix time the block lists were last refreshed.",
+	})
+)
+
+var collectors = []prometheus.Collector{blockCount, decisionCount, categoryCount, lookupDuration, listDomains, listUpdated, listErrors, lastRefresh}
+
+// registerMetrics registers the collectors with the prometheus plugin of
+// the server of c, collectors already registered are skipped. Without the
+// plugin the metrics are not exported.
+func registerMetrics(c *caddy.Controller) {
+	m, ok := dnsserver.GetConfig(c).Handler("prometheus").(*metrics.Metrics)
+	if !ok {
+		return
+	}
+	for _, collector := range collectors {
+		m.MustRegister(collector)
+	}
+}
+
+// the label values of the decision counters, actions of the query log map
+// onto them
+const (
+	gMetricBlocked    = "blocked"
+	gMetricOverride   = "override"
+	gMetricPermit     = "permit"
+	gMetricRebinding  = "rebinding"
+	gMetricQuarantine = "quarantine"
+	gMetricForwarded  = "forwarded"
+)
+
+// categories are set per list by the configuration. Past this many the rest
+// are counted as other so a bad configuration can't grow the series.
+var gMetricsMaxCategories = 32
+var gMetricOtherCategory = "other"
+
+var categoryLabels = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+func categoryLabel(category string) string {
+	categoryLabels.Lock()
+	defer categoryLabels.Unlock()
+	if categoryLabels.seen[category] {
+		return category
+	}
+	if len(categoryLabels.seen) >= gMetricsMaxCategories {
+		return gMetricOtherCategory
+	}
+	categoryLabels.seen[category] = true
+	return category
+}
+
+// metricAction returns the decision label of a query log action
+func metricAction(action string, tr *lookupTrace) string {
+	if tr.quarantined && (action == gActionBlocked || action == gActionOverride) {
+		return gMetricQuarantine
+	}
+	switch action {
+	case gActionBlocked:
+		return gMetricBlocked
+	case gActionOverride:
+		return gMetricOverride
+	case gActionPermitted:
+		return gMetricPermit
+	case gActionRebinding:
+		return gMetricRebinding
+	}
+	return gMetricForwarded
+}
+
+func recordDecision(server string, action string, tr *lookupTrace, categories []string) {
+	label := metricAction(action, tr)
+	gMetrics.Actions[label].Add(1)
+	decisionCount.WithLabelValues(server, label).Inc()
+	for _, category := range categories {
+		categoryCount.WithLabelValues(server, label, categoryLabel(category)).Inc()
+	}
+}
+
+// updateListMetrics sets the list gauges from the list meta of db, dropping
+// the series of lists that are gone
+func updateListMetrics(db *bolt.DB) {
+	meta := DBMeta{}
+	db.View(func(tx *bolt.Tx) error {
+		meta = readDBMeta(tx)
+		return nil
+	})
+
+	listDomains.Reset()
+	listUpdated.Reset()
+	for _, list := range meta.Lists {
+		id := strconv.Itoa(list.ID)
+		listDomains.WithLabelValues(id).Set(float64(list.Domains))
+		listUpdated.WithLabelValues(id).Set(float64(list.Updated))
+	}
+}
+
+// BlockMetrics is the snapshot of the metrics served by the API
+type BlockMetrics struct {
+	Uptime                     int64 //seconds since startup
+	Since                      int64 //unix time the counters were last reset
+	TotalQueries               int64
+	BlockedQueries             int64
+	Actions                    map[string]int64 //queries by what decided them
+	BlockedDomains             int64
+	LastRefresh                int64   //unix time the last list refresh finished
+	LastRefreshMilliseconds    int64   //time the last list refresh took
+	FilterBytes                int64   //memory used by the domain filter
+	FilterFalsePositiveRate    float64 //estimated share of unlisted domains passing the filter
+	FilterRejected             int64   //lookups answered by the filter alone
+	FilterFalsePositives       int64   //lookups the filter passed that were not in the store
+	Rebuilding                 bool    //the db was lost and the lists are downloaded again
+	DBBytes                    int64   //size of the db file
+	DBFreeBytes                int64   //bytes on free pages, returned by a compaction
+	DBFreeRatio                float64 //share of the db file on free pages
+	LastCompaction             int64   //unix time the last compaction finished
+	LastCompactionBeforeBytes  int64
+	LastCompactionAfterBytes   int64
+	LastCompactionMilliseconds int64
+}
+
+type atomicFloat64 struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat64) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+func (f *atomicFloat64) Store(value float64) {
+	f.bits.Store(math.Float64bits(value))
+}
+
+// blockMetrics is updated from the query path without locks. The counters
+// can be reset, the other fields report the current state.
+type blockMetrics struct {
+	started time.Time
+	mtx     sync.Mutex //orders snapshots and resets
+	since   atomic.Int64
+
+	//counters
+	TotalQueries         atomic.Int64
+	BlockedQueries       atomic.Int64
+	Actions              map[string]*atomic.Int64 //fixed keys, read only
+	FilterRejected       atomic.Int64
+	FilterFalsePositives atomic.Int64
+
+	BlockedDomains             atomic.Int64
+	LastRefresh                atomic.Int64
+	LastRefreshMilliseconds    atomic.Int64
+	FilterBytes                atomic.Int64
+	FilterFalsePositiveRate    atomicFloat64
+	Rebuilding                 atomic.Bool
+	DBBytes                    atomic.Int64
+	DBFreeBytes                atomic.Int64
+	DBFreeRatio                atomicFloat64
+	LastCompaction             atomic.Int64
+	LastCompactionBeforeBytes  atomic.Int64
+	LastCompactionAfterBytes   atomic.Int64
+	LastCompactionMilliseconds atomic.Int64
+}
+
+func newBlockMetrics() *blockMetrics {
+	m := &blockMetrics{started: time.Now(), Actions: map[string]*atomic.Int64{}}
+	m.since.Store(m.started.Unix())
+	for _, action := range []string{gMetricBlocked, gMetricOverride, gMetricPermit, gMetricRebinding, gMetricQuarantine, gMetricForwarded} {
+		m.Actions[action] = &atomic.Int64{}
+	}
+	return m
+}
+
+var gMetrics = newBlockMetrics()
+
+// snapshot reads the metrics. A query counts toward TotalQueries before its
+// action, so reading in the opposite order never reports more decisions
+// than queries.
+func (m *blockMetrics) snapshot() BlockMetrics {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	s := BlockMetrics{Actions: map[string]int64{}}
+	for action, count := range m.Actions {
+		s.Actions[action] = count.Load()
+	}
+	s.BlockedQueries = m.BlockedQueries.Load()
+	s.TotalQueries = m.TotalQueries.Load()
+	s.FilterFalsePositives = m.FilterFalsePositives.Load()
+	s.FilterRejected = m.FilterRejected.Load()
+
+	s.Uptime = int64(time.Since(m.started).Seconds())
+	s.Since = m.since.Load()
+	s.BlockedDomains = m.BlockedDomains.Load()
+	s.LastRefresh = m.LastRefresh.Load()
+	s.LastRefreshMilliseconds = m.LastRefreshMilliseconds.Load()
+	s.FilterBytes = m.FilterBytes.Load()
+	s.FilterFalsePositiveRate = m.FilterFalsePositiveRate.Load()
+	s.Rebuilding = m.Rebuilding.Load()
+	s.DBBytes = m.DBBytes.Load()
+	s.DBFreeBytes = m.DBFreeBytes.Load()
+	s.DBFreeRatio = m.DBFreeRatio.Load()
+	s.LastCompaction = m.LastCompaction.Load()
+	s.LastCompactionBeforeBytes = m.LastCompactionBeforeBytes.Load()
+	s.LastCompactionAfterBytes = m.LastCompactionAfterBytes.Load()
+	s.LastCompactionMilliseconds = m.LastCompactionMilliseconds.Load()
+	return s
+}
+
+// reset zeroes the counters, in the order they are incremented. A query
+// answered during the reset may be counted on either side of it.
+func (m *blockMetrics) reset() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
 
-var once sync.Once
+	m.TotalQueries.Store(0)
+	m.BlockedQueries.Store(0)
+	for _, count := range m.Actions {
+		count.Store(0)
+	}
+	m.FilterRejected.Store(0)
+	m.FilterFalsePositives.Store(0)
+	m.since.Store(time.Now().Unix())
+}
@@ -0,0 +1,172 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	b, srv := newTestBlock(t, "0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.com\n", []OverrideList{{Name: "main", Enabled: true,
+		PermitDomains: []DomainOverride{{Type: "Permit", Domain: "ok.ads.example.com.", ClientIP: "*"}},
+		BlockDomains:  []DomainOverride{{Type: "Block", Domain: "bad.example.org.", ClientIP: "*"}},
+	}})
+	b.config.BlockLists = append(b.config.BlockLists, ListEntry{URI: srv + "/missing", Enabled: true})
+	b.downloadLists(nil)
+
+	ads := strconv.Itoa(b.config.BlockLists[0].ID)
+	missing := strconv.Itoa(b.config.BlockLists[1].ID)
+	if value := testutil.ToFloat64(listDomains.WithLabelValues(ads)); value != 2 {
+		t.Errorf("expected 2 domains for list %s, got %v", ads, value)
+	}
+	if testutil.ToFloat64(listUpdated.WithLabelValues(ads)) == 0 || testutil.ToFloat64(lastRefresh) == 0 {
+		t.Errorf("expected the refresh time to be reported")
+	}
+	if value := testutil.ToFloat64(listErrors.WithLabelValues(missing)); value != 1 {
+		t.Errorf("expected 1 error for list %s, got %v", missing, value)
+	}
+
+	count := func(action string) float64 { return testutil.ToFloat64(decisionCount.WithLabelValues("", action)) }
+	before := map[string]float64{}
+	for _, action := range []string{"blocked", "permit", "forwarded", "rebinding"} {
+		before[action] = count(action)
+	}
+	adsBefore := testutil.ToFloat64(categoryCount.WithLabelValues("", "blocked", "ads"))
+	lookups := testutil.CollectAndCount(lookupDuration)
+
+	for _, name := range []string{"www.ads.example.com.", "tracker.example.com.", "bad.example.org.", "ok.ads.example.com.", "good.example.org.", "private.example.org."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		b.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	}
+
+	expected := map[string]float64{"blocked": 3, "permit": 1, "forwarded": 1, "rebinding": 1}
+	for action, n := range expected {
+		if got := count(action) - before[action]; got != n {
+			t.Errorf("expected %v %s decisions, got %v", n, action, got)
+		}
+	}
+	if got := testutil.ToFloat64(categoryCount.WithLabelValues("", "blocked", "ads")) - adsBefore; got != 2 {
+		t.Errorf("expected 2 blocked ads queries, got %v", got)
+	}
+	if testutil.CollectAndCount(lookupDuration) < max(lookups, 1) {
+		t.Errorf("expected lookups to be timed")
+	}
+
+	//a list deleted from the configuration drops its series
+	b.config.BlockLists = b.config.BlockLists[1:]
+	b.downloadLists(nil)
+	if testutil.CollectAndCount(listDomains) != 0 || testutil.CollectAndCount(listErrors) != 1 {
+		t.Errorf("expected the series of the deleted list to be dropped")
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	quarantined := &lookupTrace{}
+	quarantined.quarantine()
+	if action := metricAction(gActionOverride, quarantined); action != gMetricQuarantine {
+		t.Errorf("expected a quarantine decision, got %s", action)
+	}
+	if action := metricAction(gActionOverride, &lookupTrace{override: "quarantine"}); action != gMetricOverride {
+		t.Errorf("expected an override list named quarantine to be an override, got %s", action)
+	}
+	if action := metricAction(gActionPermitted, &lookupTrace{}); action != gMetricPermit {
+		t.Errorf("expected a permit decision, got %s", action)
+	}
+
+	saved := gMetricsMaxCategories
+	defer func() { gMetricsMaxCategories = saved }()
+	gMetricsMaxCategories = len(categoryLabels.seen) + 1
+
+	if label := categoryLabel("first-new-category"); label != "first-new-category" {
+		t.Errorf("expected the category to be kept, got %s", label)
+	}
+	if label := categoryLabel("second-new-category"); label != gMetricOtherCategory {
+		t.Errorf("expected categories past the limit to be other, got %s", label)
+	}
+}
+
+func getMetricsAPI(t *testing.T, b *Block, method string) BlockMetrics {
+	rr := httptest.NewRecorder()
+	b.getMetrics(rr, httptest.NewRequest(method, "/metrics", nil))
+	m := BlockMetrics{}
+	if err := json.NewDecoder(rr.Body).Decode(&m); err != nil {
+		t.Errorf("%s /metrics: unexpected response %d: %v", method, rr.Code, err)
+	}
+	return m
+}
+
+// run with -race
+func TestMetricsRace(t *testing.T) {
+	b, _ := newTestBlock(t, "0.0.0.0 ads.example.com\n", nil)
+
+	names := []string{"www.ads.example.com.", "good.example.org.", "private.example.org."}
+	query := func(i int) {
+		req := new(dns.Msg)
+		req.SetQuestion(names[i%len(names)], dns.TypeA)
+		b.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				query(i + j)
+			}
+		}(i)
+	}
+	var readers sync.WaitGroup
+	for _, method := range []string{"GET", "GET", "DELETE"} {
+		readers.Add(1)
+		go func(method string) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				m := getMetricsAPI(t, b, method)
+				if method == "GET" && m.Uptime < 0 {
+					t.Errorf("unexpected uptime %d", m.Uptime)
+				}
+			}
+		}(method)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	reset := getMetricsAPI(t, b, "DELETE")
+	if reset.TotalQueries != 0 || reset.BlockedQueries != 0 || reset.Actions["blocked"] != 0 {
+		t.Fatalf("expected the counters to be reset, got %+v", reset)
+	}
+
+	for i := 0; i < 30; i++ {
+		query(i)
+	}
+	m := getMetricsAPI(t, b, "GET")
+	decided := int64(0)
+	for _, count := range m.Actions {
+		decided += count
+	}
+	if m.TotalQueries != 30 || m.BlockedQueries != 10 || decided != 30 {
+		t.Errorf("expected 30 queries and 10 blocked, got %+v", m)
+	}
+	if m.Actions["blocked"] != 10 || m.Actions["rebinding"] != 10 || m.Actions["forwarded"] != 10 {
+		t.Errorf("unexpected actions %v", m.Actions)
+	}
+	if m.Since < reset.Since || m.BlockedDomains != 1 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+}
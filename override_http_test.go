@@ -7,11 +7,18 @@ import (
 	"github.com/gorilla/mux"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 )
 
 func TestModifyOverrideList(t *testing.T) {
-	CONFIG_PATH = "./test_data/block_rules.json"
+	//the config is saved, work on a copy of the fixture
+	fixture, err := os.ReadFile("./test_data/block_rules.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	CONFIG_PATH = t.TempDir() + "/block_rules.json"
+	os.WriteFile(CONFIG_PATH, fixture, 0644)
 
 	// Create a new test block
 	b := New()
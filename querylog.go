@@ -0,0 +1,410 @@
+package block
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	bolt "go.etcd.io/bbolt"
+)
+
+// what ServeDNS did with a query
+const (
+	gActionBlocked   = "blocked"
+	gActionOverride  = "override"  //answered from an override
+	gActionPermitted = "permitted" //forwarded by a permit override, without rebinding check
+	gActionForwarded = "forwarded"
+	gActionRebinding = "rebinding" //blocked for a private address in the answer
+)
+
+// query log defaults, the log is trimmed to both
+var gQueryLogMaxEntries = 100000
+var gQueryLogRetention = time.Hour * 24 * 7
+
+// entries are written in batches off the query path, a full queue drops
+// entries rather than holding up queries
+var gQueryLogQueue = 4096
+var gQueryLogBatch = 1024
+var gQueryLogFlushInterval = time.Second
+
+var gQueryLogBucket = "querylog"
+
+// entries of a page of GET /querylog by default and at most, and the
+// entries walked at most for a page
+var gQueryLogPageLimit = 100
+var gQueryLogMaxLimit = 1000
+var gQueryLogScanLimit = 100000
+
+type QueryLogEntry struct {
+	Time     time.Time
+	Client   string
+	Name     string
+	QType    string
+	Action   string
+	ListIDs  []int  `json:",omitempty"` //lists the name was found on
+	Override string `json:",omitempty"` //override list, quarantine or client exclusion that decided
+	Latency  int64  //microseconds to answer
+}
+
+func newQueryLogEntry(start time.Time, state request.Request, action string, tr *lookupTrace) QueryLogEntry {
+	return QueryLogEntry{
+		Time:     start,
+		Client:   state.IP(),
+		Name:     state.Name(),
+		QType:    state.Type(),
+		Action:   action,
+		ListIDs:  tr.list_ids,
+		Override: tr.override,
+		Latency:  time.Since(start).Microseconds(),
+	}
+}
+
+// queryLog keeps entries in their own db, keyed by time so they are
+// stored in order and trimmed from the front
+type queryLog struct {
+	db         *bolt.DB
+	entries    chan QueryLogEntry //never closed, queries may still be sending
+	flushes    chan chan struct{}
+	stop       chan struct{}
+	done       chan struct{}
+	maxEntries int
+	retention  time.Duration
+	count      int //entries stored, owned by run
+	seq        uint32
+	dropped    atomic.Int64
+}
+
+func openQueryLog(filename string, maxEntries int, retention time.Duration) (*queryLog, error) {
+	db, err := bolt.Open(filename, 0664, &bolt.Options{Timeout: 1 * time.Second, NoSync: true})
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(gQueryLogBucket))
+		if err == nil {
+			count = bucket.Stats().KeyN
+		}
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	l := &queryLog{
+		db:         db,
+		entries:    make(chan QueryLogEntry, gQueryLogQueue),
+		flushes:    make(chan chan struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		maxEntries: maxEntries,
+		retention:  retention,
+		count:      count,
+	}
+	go l.run()
+	return l, nil
+}
+
+// record queues entry without blocking. Once the log is closed entries
+// are dropped.
+func (l *queryLog) record(entry QueryLogEntry) {
+	select {
+	case <-l.stop:
+		return
+	default:
+	}
+	select {
+	case l.entries <- entry:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// flush waits until the queued entries are written
+func (l *queryLog) flush() {
+	ack := make(chan struct{})
+	select {
+	case l.flushes <- ack:
+		<-ack
+	case <-l.done:
+	}
+}
+
+// close writes the queued entries and closes the db
+func (l *queryLog) close() {
+	close(l.stop)
+	<-l.done
+}
+
+// drain takes the entries queued so far into batch
+func (l *queryLog) drain(batch []QueryLogEntry) []QueryLogEntry {
+	for len(l.entries) > 0 {
+		batch = append(batch, <-l.entries)
+	}
+	return batch
+}
+
+func (l *queryLog) run() {
+	defer close(l.done)
+	defer l.db.Close()
+
+	tick := time.NewTicker(gQueryLogFlushInterval)
+	defer tick.Stop()
+
+	batch := []QueryLogEntry{}
+	for {
+		select {
+		case <-l.stop:
+			l.write(l.drain(batch))
+			return
+		case entry := <-l.entries:
+			batch = append(batch, entry)
+			if len(batch) < gQueryLogBatch {
+				continue
+			}
+		case ack := <-l.flushes:
+			//take what is queued
+			l.write(l.drain(batch))
+			batch = batch[:0]
+			close(ack)
+			continue
+		case <-tick.C:
+		}
+		l.write(batch)
+		batch = batch[:0]
+	}
+}
+
+func (l *queryLog) key(t time.Time) []byte {
+	l.seq++
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(key[8:], l.seq)
+	return key
+}
+
+// write stores batch and trims the log to its size and age
+func (l *queryLog) write(batch []QueryLogEntry) {
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(gQueryLogBucket))
+		for _, entry := range batch {
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put(l.key(entry.Time), value)
+			if err != nil {
+				return err
+			}
+			l.count++
+		}
+
+		cutoff := uint64(time.Now().Add(-l.retention).UnixNano())
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.First() {
+			if l.count <= l.maxEntries && binary.BigEndian.Uint64(k) >= cutoff {
+				break
+			}
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+			l.count--
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warningf("Failed to write query log: %s", err)
+	}
+}
+
+// QueryLogQuery selects entries of the log. Domain matches the name and
+// its subdomains, or with a * the whole name as a pattern.
+type QueryLogQuery struct {
+	Client string
+	Domain string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Cursor string //key of the last entry of the previous page
+	Limit  int
+}
+
+type QueryLogPage struct {
+	Entries []QueryLogEntry
+	Dropped int64  //entries lost to a full queue since startup
+	Next    string `json:",omitempty"` //cursor of the next page, empty at the end
+}
+
+func (q QueryLogQuery) matches(entry QueryLogEntry) bool {
+	if q.Client != "" && entry.Client != q.Client {
+		return false
+	}
+	if q.Action != "" && entry.Action != q.Action {
+		return false
+	}
+	if q.Domain != "" {
+		if strings.Contains(q.Domain, "*") {
+			matched, _ := path.Match(q.Domain, entry.Name)
+			return matched
+		}
+		return entry.Name == q.Domain || strings.HasSuffix(entry.Name, "."+q.Domain)
+	}
+	return true
+}
+
+// search returns the entries matching q, newest first, walking at most
+// gQueryLogScanLimit entries per page
+func (l *queryLog) search(q QueryLogQuery) (QueryLogPage, error) {
+	page := QueryLogPage{Entries: []QueryLogEntry{}, Dropped: l.dropped.Load()}
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(gQueryLogBucket)).Cursor()
+
+		var k, v []byte
+		if q.Cursor != "" {
+			cursor, err := hex.DecodeString(q.Cursor)
+			if err != nil {
+				return err
+			}
+			k, v = c.Seek(cursor)
+			if k == nil {
+				k, v = c.Last()
+			}
+			for k != nil && string(k) >= string(cursor) {
+				k, v = c.Prev()
+			}
+		} else if !q.Until.IsZero() {
+			until := make([]byte, 8)
+			binary.BigEndian.PutUint64(until, uint64(q.Until.UnixNano()+1))
+			k, v = c.Seek(until)
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		} else {
+			k, v = c.Last()
+		}
+
+		scanned := 0
+		var last []byte
+		for ; k != nil; k, v = c.Prev() {
+			if !q.Since.IsZero() && int64(binary.BigEndian.Uint64(k)) < q.Since.UnixNano() {
+				return nil
+			}
+			if len(page.Entries) == q.Limit || scanned == gQueryLogScanLimit {
+				page.Next = hex.EncodeToString(last)
+				return nil
+			}
+			scanned++
+			last = append(last[:0], k...)
+
+			entry := QueryLogEntry{}
+			if json.Unmarshal(v, &entry) != nil || !q.matches(entry) {
+				continue
+			}
+			page.Entries = append(page.Entries, entry)
+		}
+		return nil
+	})
+
+	return page, err
+}
+
+// setupQueryLog opens or closes the query log as configured
+func (b *Block) setupQueryLog() {
+	if !b.config.QueryLog {
+		if old := b.querylog.Swap(nil); old != nil {
+			old.close()
+		}
+		return
+	}
+	if b.querylog.Load() != nil {
+		return
+	}
+
+	maxEntries := gQueryLogMaxEntries
+	if b.config.QueryLogMaxEntries > 0 {
+		maxEntries = b.config.QueryLogMaxEntries
+	}
+	retention := gQueryLogRetention
+	if b.config.QueryLogRetentionSeconds > 0 {
+		retention = time.Duration(b.config.QueryLogRetentionSeconds) * time.Second
+	}
+
+	l, err := openQueryLog(b.DbPath+"-querylog", maxEntries, retention)
+	if err != nil {
+		log.Warningf("Failed to open query log: %s", err)
+		return
+	}
+	b.querylog.Store(l)
+}
+
+// parseQueryTime reads unix seconds or RFC 3339
+func parseQueryTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (b *Block) searchQueryLog(w http.ResponseWriter, r *http.Request) {
+	l := b.querylog.Load()
+	if l == nil {
+		http.Error(w, "query log is disabled", 400)
+		return
+	}
+
+	params := r.URL.Query()
+	q := QueryLogQuery{
+		Client: params.Get("client"),
+		Domain: strings.TrimSuffix(strings.ToLower(params.Get("domain")), ".") + ".",
+		Action: params.Get("action"),
+		Cursor: params.Get("cursor"),
+		Limit:  gQueryLogPageLimit,
+	}
+	if q.Domain == "." {
+		q.Domain = ""
+	}
+
+	var err error
+	if since := params.Get("since"); since != "" {
+		if q.Since, err = parseQueryTime(since); err != nil {
+			http.Error(w, "invalid since", 400)
+			return
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if q.Until, err = parseQueryTime(until); err != nil {
+			http.Error(w, "invalid until", 400)
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		i, err := strconv.Atoi(limit)
+		if err != nil || i <= 0 {
+			http.Error(w, "invalid limit", 400)
+			return
+		}
+		q.Limit = min(i, gQueryLogMaxLimit)
+	}
+
+	page, err := l.search(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
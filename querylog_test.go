@@ -0,0 +1,206 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// upstream answers every query, private.example.org. with a private address
+var upstream = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	ip := "93.184.216.34"
+	if r.Question[0].Name == "private.example.org." {
+		ip = "192.168.1.1"
+	}
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	})
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+})
+
+// newTestBlock sets up a Block in a temporary directory that answers from
+// upstream, with overrides and a list at srv/ads holding body, and downloads
+// the list. Other paths of srv are not found.
+func newTestBlock(t *testing.T, body string, overrides []OverrideList) (b *Block, srv string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ads" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	b = New()
+	b.setupDB(t.TempDir() + "/block.db")
+	t.Cleanup(b.closeDB)
+	b.Next = upstream
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{{URI: server.URL + "/ads", Enabled: true, Category: "ads"}}
+	b.config.OverrideLists = overrides
+	b.downloadLists(nil)
+	return b, server.URL
+}
+
+func searchLog(t *testing.T, b *Block, query url.Values) QueryLogPage {
+	rr := httptest.NewRecorder()
+	b.searchQueryLog(rr, httptest.NewRequest("GET", "/querylog?"+query.Encode(), nil))
+	page := QueryLogPage{}
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatalf("%s: unexpected response %d: %v", query.Encode(), rr.Code, err)
+	}
+	return page
+}
+
+func TestQueryLog(t *testing.T) {
+	b, _ := newTestBlock(t, "0.0.0.0 ads.example.com\n", []OverrideList{{Name: "main", Enabled: true,
+		PermitDomains: []DomainOverride{{Type: "Permit", Domain: "ok.ads.example.com.", ClientIP: "*"}},
+		BlockDomains:  []DomainOverride{{Type: "Block", Domain: "bad.example.org.", ClientIP: "*"}},
+	}})
+
+	rr := httptest.NewRecorder()
+	b.searchQueryLog(rr, httptest.NewRequest("GET", "/querylog", nil))
+	if rr.Code != 400 {
+		t.Errorf("expected the disabled query log to fail, got %d", rr.Code)
+	}
+
+	b.config.QueryLog = true
+	b.setupQueryLog()
+
+	for _, name := range []string{"www.ads.example.com.", "bad.example.org.", "ok.ads.example.com.", "good.example.org.", "private.example.org."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		b.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	}
+	b.querylog.Load().flush()
+
+	page := searchLog(t, b, url.Values{})
+	actions := []string{}
+	for _, entry := range page.Entries {
+		actions = append(actions, entry.Action)
+	}
+	if !slices.Equal(actions, []string{"rebinding", "forwarded", "permitted", "blocked", "blocked"}) {
+		t.Fatalf("unexpected actions newest first %v", actions)
+	}
+	blocked := page.Entries[4]
+	if blocked.Name != "www.ads.example.com." || !slices.Equal(blocked.ListIDs, []int{0}) || blocked.Client != "10.240.0.1" || blocked.QType != "A" {
+		t.Errorf("unexpected entry %+v", blocked)
+	}
+	if page.Entries[3].Override != "main" || page.Entries[2].Override != "main" {
+		t.Errorf("expected the override list to be logged, got %+v", page.Entries[2:4])
+	}
+
+	for _, test := range []struct {
+		query url.Values
+		count int
+	}{
+		{url.Values{"action": {"blocked"}}, 2},
+		{url.Values{"client": {"10.240.0.1"}}, 5},
+		{url.Values{"client": {"10.240.0.2"}}, 0},
+		{url.Values{"domain": {"example.org"}}, 3},
+		{url.Values{"domain": {"*.ads.example.com"}}, 2},
+		{url.Values{"since": {time.Now().Add(time.Minute).Format(time.RFC3339)}}, 0},
+		{url.Values{"until": {"1000"}}, 0},
+		{url.Values{"since": {"1000"}, "until": {time.Now().Add(time.Minute).Format(time.RFC3339)}}, 5},
+	} {
+		if got := len(searchLog(t, b, test.query).Entries); got != test.count {
+			t.Errorf("%s: expected %d entries, got %d", test.query.Encode(), test.count, got)
+		}
+	}
+
+	names := []string{}
+	query := url.Values{"limit": {"2"}}
+	for pages := 0; pages < 10; pages++ {
+		page := searchLog(t, b, query)
+		for _, entry := range page.Entries {
+			names = append(names, entry.Name)
+		}
+		if page.Next == "" {
+			break
+		}
+		query.Set("cursor", page.Next)
+	}
+	if len(names) != 5 || names[0] != "private.example.org." || names[4] != "www.ads.example.com." {
+		t.Errorf("unexpected names over pages %v", names)
+	}
+
+	//entries survive a restart
+	b.querylog.Swap(nil).close()
+	b.setupQueryLog()
+	defer b.querylog.Load().close()
+	if got := len(searchLog(t, b, url.Values{}).Entries); got != 5 {
+		t.Errorf("expected 5 entries after reopening, got %d", got)
+	}
+}
+
+func TestQueryLogRetention(t *testing.T) {
+	os.Remove("/tmp/querylog_retention.db")
+	l, err := openQueryLog("/tmp/querylog_retention.db", 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	l.record(QueryLogEntry{Time: time.Now().Add(-2 * time.Hour), Name: "old.example.com."})
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		l.record(QueryLogEntry{Time: time.Now(), Name: name})
+	}
+	l.flush()
+	page, _ := l.search(QueryLogQuery{Limit: 10})
+	if len(page.Entries) != 2 {
+		t.Errorf("expected the expired entry to be trimmed, got %d entries", len(page.Entries))
+	}
+
+	for _, name := range []string{"c.example.com.", "d.example.com."} {
+		l.record(QueryLogEntry{Time: time.Now(), Name: name})
+	}
+	l.flush()
+	page, _ = l.search(QueryLogQuery{Limit: 10})
+	names := []string{}
+	for _, entry := range page.Entries {
+		names = append(names, entry.Name)
+	}
+	if !slices.Equal(names, []string{"d.example.com.", "c.example.com.", "b.example.com."}) {
+		t.Errorf("expected the newest 3 entries, got %v", names)
+	}
+}
+
+func TestQueryLogClose(t *testing.T) {
+	l, err := openQueryLog(t.TempDir()+"/querylog.db", 100, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//queries in flight keep recording while the log is closed
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				l.record(QueryLogEntry{Time: time.Now(), Name: "a.example.com."})
+			}
+		}()
+	}
+	l.close()
+	wg.Wait()
+
+	l.record(QueryLogEntry{Time: time.Now(), Name: "late.example.com."})
+	l.flush()
+}
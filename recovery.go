@@ -0,0 +1,270 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOpen opens or creates the db at filename with the domain bucket in
+// place. bolt panics on some corrupt files instead of returning an error,
+// those are returned as errors too.
+func boltOpen(filename string, options *bolt.Options) (db *bolt.DB, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if db != nil {
+				db.Close()
+				db = nil
+			}
+			err = fmt.Errorf("failed to open %s: %v", filename, r)
+		}
+	}()
+
+	db, err = bolt.Open(filename, 0664, options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(gDomainBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	db.Sync()
+	return db, nil
+}
+
+// checkDB walks every page of db and reports the first inconsistency.
+// Values are not decoded, that would read the whole db on every start and
+// a lookup takes a value that does not decode as not listed.
+func checkDB(db *bolt.DB) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("integrity check failed: %v", r)
+		}
+	}()
+
+	return db.View(func(tx *bolt.Tx) error {
+		for cerr := range tx.Check() {
+			return fmt.Errorf("integrity check failed: %w", cerr)
+		}
+		return nil
+	})
+}
+
+// openChecked opens the live db at filename and checks it. Commits are not
+// synced to spare the flash of the router, a crash can leave the db
+// inconsistent. The check catches that and openDB falls back to the backup
+// of the last refresh or swap.
+func openChecked(filename string) (*bolt.DB, error) {
+	db, err := boltOpen(filename, &bolt.Options{Timeout: 1 * time.Second, NoSync: true})
+	if err != nil {
+		return nil, err
+	}
+	err = checkDB(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// reasons a db is quarantined for, only the newest quarantined copy is kept
+var gQuarantineReasons = []string{"corrupt", "unsupported"}
+
+// quarantineDB moves the db at filename aside for inspection, the name
+// says why it was taken out of use. Older quarantined copies are removed.
+func quarantineDB(filename string, reason string) {
+	for _, old := range gQuarantineReasons {
+		matches, _ := filepath.Glob(filename + "." + old + "-*")
+		for _, match := range matches {
+			os.Remove(match)
+		}
+	}
+
+	aside := fmt.Sprintf("%s.%s-%d", filename, reason, time.Now().Unix())
+	log.Warningf("Moving database %s to %s", filename, aside)
+	if err := os.Rename(filename, aside); err != nil {
+		log.Warningf("Failed to move %s: %s", filename, err)
+		os.Remove(filename)
+	}
+}
+
+func syncFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// swapDB replaces the db file at path with tmp and keeps the replaced file
+// as path.bak. The rename is atomic and the new file is synced before it,
+// so after a crash path holds either the old or the new db, never a mix.
+func swapDB(path string, tmp string) error {
+	err := syncFile(tmp)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(path + ".bak")
+	err = os.Link(path, path+".bak")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warningf("Failed to keep a backup of %s: %s", path, err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// checkDiskSpace fails when the file system of dir has less than size
+// bytes and a tenth to spare. When the space is not known the write is
+// tried anyway.
+func checkDiskSpace(dir string, size int64) error {
+	needed := size + size/10
+	available, err := diskAvailable(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if available < needed {
+		return fmt.Errorf("not enough disk space, %d bytes needed, %d available", needed, available)
+	}
+	return nil
+}
+
+// backupDB replaces the backup at path.bak with a synced copy of db.
+// Refreshes patch the live db in place without syncing, the copy taken
+// after a refresh is what openDB falls back to when a crash left the live
+// db inconsistent.
+func backupDB(db *bolt.DB, path string) error {
+	tmp := path + ".bak-new"
+	err := db.View(func(tx *bolt.Tx) error {
+		err := checkDiskSpace(filepath.Dir(path), tx.Size())
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+		if err != nil {
+			return err
+		}
+		_, err = tx.WriteTo(f)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err == nil {
+		err = os.Rename(tmp, path+".bak")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// restoreBackup puts a copy of the backup of the last refresh or swap in
+// place of the db at path. The backup itself is kept.
+func restoreBackup(path string) error {
+	src, err := os.Open(path + ".bak")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".restore"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// openDB opens the live db at filename, checks and migrates it. A corrupt
+// db is quarantined and replaced by the backup of the last refresh or swap when that
+// one is intact, otherwise by an empty db. A db that cannot be migrated,
+// like one written by a newer version, is moved aside as well. rebuilt is
+// set when the lists were lost and have to be downloaded again.
+func openDB(filename string) (db *bolt.DB, rebuilt bool) {
+	db, err := openChecked(filename)
+	if errors.Is(err, bolt.ErrTimeout) {
+		//held by another process, not corrupt
+		log.Fatal("Failed to open ", filename, err)
+	}
+	if err != nil {
+		log.Warningf("Database %s is corrupt: %s", filename, err)
+		quarantineDB(filename, "corrupt")
+
+		if rerr := restoreBackup(filename); rerr == nil {
+			db, err = openChecked(filename)
+			if err == nil {
+				log.Warningf("Restored database %s from backup", filename)
+			} else {
+				log.Warningf("Backup of %s is corrupt: %s", filename, err)
+				quarantineDB(filename, "corrupt")
+			}
+		}
+	}
+
+	if err == nil {
+		err = migrateDB(db)
+		if err == nil {
+			return db, false
+		}
+		db.Close()
+		log.Warningf("Database %s can not be used: %s", filename, err)
+		quarantineDB(filename, "unsupported")
+	}
+
+	//start over, the lists are downloaded again
+	db, err = openChecked(filename)
+	if err != nil {
+		log.Fatal("Failed to create database ", filename, err)
+	}
+	err = migrateDB(db)
+	if err != nil {
+		log.Warningf("Failed to set up new database: %s", err)
+	}
+	return db, true
+}
@@ -0,0 +1,141 @@
+package block
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func putDomain(path string, domain string) {
+	db := BoltOpen(path)
+	updateDomains(db, map[string]DomainValue{domain: {List_ids: []int{0}}})
+	db.Close()
+}
+
+func TestSwapDB(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "block.db")
+	putDomain(path, "old.example.com.")
+	putDomain(path+".tmp", "new.example.com.")
+
+	if err := swapDB(path, path+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	db := BoltOpen(path)
+	err, _ := getItem(db, gDomainBucket, "new.example.com.")
+	db.Close()
+	if err != nil {
+		t.Errorf("expected the new db in place: %v", err)
+	}
+
+	db = BoltOpen(path + ".bak")
+	err, _ = getItem(db, gDomainBucket, "old.example.com.")
+	db.Close()
+	if err != nil {
+		t.Errorf("expected the old db as backup: %v", err)
+	}
+}
+
+// corruptDB overwrites the pages of the db at path past the meta pages,
+// or the whole file with all set
+func corruptDB(path string, all bool) {
+	data, _ := os.ReadFile(path)
+	start := 2 * os.Getpagesize()
+	if all {
+		start = 0
+	}
+	for i := start; i < len(data); i++ {
+		data[i] = 0xa5
+	}
+	os.WriteFile(path, data, 0664)
+}
+
+func TestCorruptDBRestoresBackup(t *testing.T) {
+	for _, all := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "block.db")
+		putDomain(path, "listed.example.com.")
+		data, _ := os.ReadFile(path)
+		os.WriteFile(path+".bak", data, 0664)
+		corruptDB(path, all)
+
+		b := New()
+		b.setupDB(path)
+		if _, found := b.getDomain("listed.example.com."); !found {
+			t.Errorf("all=%v: expected the db to be restored from the backup", all)
+		}
+		if b.rebuilding.Load() {
+			t.Errorf("all=%v: expected no rebuild with an intact backup", all)
+		}
+		b.closeDB()
+
+		quarantined, _ := filepath.Glob(path + ".corrupt-*")
+		if len(quarantined) != 1 {
+			t.Errorf("all=%v: expected the corrupt db to be quarantined, got %v", all, quarantined)
+		}
+	}
+}
+
+func TestRefreshKeepsBackup(t *testing.T) {
+	b, _ := newTestBlock(t, "0.0.0.0 ads.example.com\n", nil)
+	b.closeDB()
+	corruptDB(b.DbPath, false)
+
+	//the unsynced refresh was lost, the backup taken after it is restored
+	restored := New()
+	restored.setupDB(b.DbPath)
+	defer restored.closeDB()
+	if _, found := restored.getDomain("ads.example.com."); !found {
+		t.Errorf("expected the refreshed db to be restored from the backup")
+	}
+	if restored.rebuilding.Load() {
+		t.Errorf("expected no rebuild with a backup of the refresh")
+	}
+}
+
+func TestCorruptDBRebuild(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "block.db")
+		putDomain(path, "listed.example.com.")
+		corruptDB(path, false)
+
+		b := New()
+		b.setupDB(path)
+		b.superapi_enabled = true
+		b.config.FailClosed = failClosed
+
+		if !b.rebuilding.Load() || !gMetrics.Rebuilding.Load() {
+			t.Fatalf("expected a rebuild without a backup")
+		}
+
+		returnIP, returnCNAME, hasPermit, categories := "", "", false, []string{}
+		if b.blocked("192.168.2.10", "www.example.org.", &returnIP, &returnCNAME, &hasPermit, &categories) != failClosed {
+			t.Errorf("failClosed=%v: unexpected result during the rebuild", failClosed)
+		}
+
+		b.downloadLists(nil)
+		if b.rebuilding.Load() {
+			t.Errorf("expected the rebuild to end with a full refresh")
+		}
+		if b.blocked("192.168.2.10", "www.example.org.", &returnIP, &returnCNAME, &hasPermit, &categories) {
+			t.Errorf("failClosed=%v: expected www.example.org. to pass after the rebuild", failClosed)
+		}
+		b.closeDB()
+	}
+}
+
+func TestQuarantineKeepsNewest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.db")
+	putDomain(path, "listed.example.com.")
+	quarantineDB(path, "corrupt")
+	putDomain(path, "listed.example.com.")
+	quarantineDB(path, "unsupported")
+
+	corrupt, _ := filepath.Glob(path + ".corrupt-*")
+	unsupported, _ := filepath.Glob(path + ".unsupported-*")
+	if len(corrupt) != 0 || len(unsupported) != 1 {
+		t.Errorf("expected only the newest quarantined copy, got %v %v", corrupt, unsupported)
+	}
+}
@@ -0,0 +1,116 @@
+package block
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// failed lists are retried after gRetryBaseDelay, doubling with every
+// further failure up to gRetryMaxDelay
+var gRetryBaseDelay = time.Minute
+var gRetryMaxDelay = 6 * time.Hour
+
+type listRetry struct {
+	Failures int
+	Next     time.Time
+}
+
+// retryScheduler keeps the backoff state of failed lists, keyed by URI
+type retryScheduler struct {
+	mtx   sync.Mutex
+	lists map[string]*listRetry
+	kick  chan struct{}
+}
+
+func newRetryScheduler() *retryScheduler {
+	return &retryScheduler{
+		lists: map[string]*listRetry{},
+		kick:  make(chan struct{}, 1),
+	}
+}
+
+// backoffDelay returns the wait before retry number failures. Half of the
+// delay is random so lists failing together, like all lists of one host,
+// do not retry in lockstep.
+func backoffDelay(failures int) time.Duration {
+	d := gRetryBaseDelay
+	for i := 1; i < failures && d < gRetryMaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, gRetryMaxDelay)
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// record updates the backoff from download results. Successful lists are
+// forgotten, failed lists are scheduled for their next attempt.
+func (r *retryScheduler) record(results map[string]error) {
+	r.mtx.Lock()
+	now := time.Now()
+	for uri, err := range results {
+		if err == nil {
+			delete(r.lists, uri)
+			setListRetry(uri, 0, time.Time{})
+			continue
+		}
+
+		retry, exists := r.lists[uri]
+		if !exists {
+			retry = &listRetry{}
+			r.lists[uri] = retry
+		}
+		retry.Failures++
+		retry.Next = now.Add(backoffDelay(retry.Failures))
+		setListRetry(uri, retry.Failures, retry.Next)
+		log.Infof("Retrying block list %q in %s", uri, retry.Next.Sub(now).Round(time.Second))
+	}
+	r.mtx.Unlock()
+
+	//wake up the refresh loop to pick up the new schedule
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// due returns the lists whose retry time has come
+func (r *retryScheduler) due(now time.Time) []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	uris := []string{}
+	for uri, retry := range r.lists {
+		if !retry.Next.After(now) {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// next returns the earliest scheduled retry
+func (r *retryScheduler) next() (time.Time, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	var next time.Time
+	for _, retry := range r.lists {
+		if next.IsZero() || retry.Next.Before(next) {
+			next = retry.Next
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// forget drops lists that are no longer downloaded
+func (r *retryScheduler) forget(keep func(uri string) bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for uri := range r.lists {
+		if !keep(uri) {
+			delete(r.lists, uri)
+			setListRetry(uri, 0, time.Time{})
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package block
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	for failures := 1; failures < 20; failures++ {
+		full := min(gRetryBaseDelay<<(failures-1), gRetryMaxDelay)
+		for i := 0; i < 100; i++ {
+			d := backoffDelay(failures)
+			if d < full/2 || d > full {
+				t.Fatalf("delay %s for %d failures outside of [%s, %s]", d, failures, full/2, full)
+			}
+		}
+	}
+}
+
+func TestRetryScheduler(t *testing.T) {
+	r := newRetryScheduler()
+
+	r.record(map[string]error{"a": errors.New("failed"), "b": nil})
+	if _, ok := r.lists["b"]; ok {
+		t.Errorf("successful list should not be scheduled")
+	}
+
+	next, ok := r.next()
+	if !ok || next.Before(time.Now().Add(gRetryBaseDelay/2-time.Second)) {
+		t.Errorf("expected a retry after about %s, got %v", gRetryBaseDelay, next)
+	}
+
+	if len(r.due(time.Now())) != 0 {
+		t.Errorf("retry should not be due yet")
+	}
+	if due := r.due(next); len(due) != 1 || due[0] != "a" {
+		t.Errorf("expected a to be due, got %v", due)
+	}
+
+	r.record(map[string]error{"a": errors.New("failed again")})
+	if r.lists["a"].Failures != 2 || getListStatus("a").Failures != 2 {
+		t.Errorf("expected two failures to be counted")
+	}
+
+	r.record(map[string]error{"a": nil})
+	if _, ok := r.next(); ok || getListStatus("a").NextRetry != 0 {
+		t.Errorf("expected no retry after success")
+	}
+}
+
+func TestRetryOnlyFailedLists(t *testing.T) {
+	var mtx sync.Mutex
+	requests := map[string]int{}
+	flaky := true
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests[r.URL.Path]++
+		if r.URL.Path == "/flaky" && flaky {
+			http.Error(w, "unavailable", 503)
+			return
+		}
+		w.Write([]byte("0.0.0.0 " + r.URL.Path[1:] + ".example.com\n"))
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/retry.db")
+	b := New()
+	b.setupDB("/tmp/retry.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{
+		{URI: srv.URL + "/stable", Enabled: true},
+		{URI: srv.URL + "/flaky", Enabled: true},
+	}
+
+	results := b.downloadLists(nil)
+	if results[srv.URL+"/stable"] != nil || results[srv.URL+"/flaky"] == nil {
+		t.Fatalf("unexpected results %v", results)
+	}
+	b.retries.record(results)
+
+	mtx.Lock()
+	flaky = false
+	mtx.Unlock()
+
+	next, _ := b.retries.next()
+	due := b.retries.due(next)
+	results = b.downloadLists(due)
+	if len(results) != 1 || results[srv.URL+"/flaky"] != nil {
+		t.Fatalf("expected only the flaky list to be retried, got %v", results)
+	}
+
+	if requests["/stable"] != 1 || requests["/flaky"] != 2 {
+		t.Errorf("unexpected requests %v", requests)
+	}
+
+	for _, name := range []string{"stable.example.com.", "flaky.example.com."} {
+		if _, found := b.getDomain(name); !found {
+			t.Errorf("missing %s after retry", name)
+		}
+	}
+}
+
+func TestRefreshStopsDuringBackoff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", 503)
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/retry.db")
+	b := New()
+	b.setupDB("/tmp/retry.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.BlockLists = []ListEntry{{URI: srv.URL + "/down", Enabled: true}}
+
+	done := make(chan struct{})
+	go func() {
+		b.refresh()
+		close(done)
+	}()
+
+	//wait for the first download to fail and a retry to be scheduled
+	for i := 0; i < 100; i++ {
+		if _, ok := b.retries.next(); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(b.stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("refresh did not stop while waiting for a retry")
+	}
+}
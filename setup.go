@@ -7,7 +7,6 @@ import (
 	"github.com/coredns/caddy"
 
 	"sync"
-	"time"
 )
 
 var doOnce sync.Once
@@ -34,36 +33,34 @@ func setup(c *caddy.Controller) error {
 	block.superapi_enabled = superapi_enabled
 
 	c.OnStartup(func() error {
+		registerMetrics(c)
 
 		block.setupDB(gDbPath)
 
 		doOnce.Do(func() {
+			block.loadStats()
+
 			//Multiple server instances could be running, but the plugin only needs
 			//one instance to download and refresh the list
 			go func() {
 				//spr is enabled
 				if block.superapi_enabled {
+					block.MigrateConfig()
 					block.loadSPRConfig()
+					block.selectStore()
+					block.setupQueryLog()
+					block.setupDnstap()
+					go block.runAPI()
 				}
 
-				if block.superapi_enabled {
-					block.runAPI()
-				}
-
-				retries := 3
-				for retries > 0 {
-					block.download()
-					time.Sleep(time.Second * 10)
-					if !block.ShouldRetryRefresh() {
-						break
-					}
-					retries--
-					time.Sleep(time.Minute * 5)
-				}
+				go block.compaction()
+				go block.persistStats()
 
+				//downloads the lists now and on every refresh, retrying
+				//failed lists in between
+				block.refresh()
 			}()
 
-			go func() { block.refresh() }()
 			go func() { block.refreshTags() }()
 
 		})
@@ -73,6 +70,12 @@ func setup(c *caddy.Controller) error {
 
 	c.OnShutdown(func() error {
 		close(block.stop)
+		if l := block.querylog.Swap(nil); l != nil {
+			l.close()
+		}
+		if t := block.dnstap.Swap(nil); t != nil {
+			t.close()
+		}
 		return nil
 	})
 
@@ -0,0 +1,436 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A snapshot is a gzip stream of a JSON header line followed by one record
+// per domain: the uvarint length and bytes of the name, then of the value
+// in the compact encoding. A record with an empty name ends it.
+var gSnapshotFormat = "coredns-block snapshot"
+var gSnapshotVersion = 1
+
+var ErrSnapshot = errors.New("invalid snapshot")
+
+type SnapshotHeader struct {
+	Format  string
+	Version int
+	Created int64
+	Domains int64
+	Meta    DBMeta
+}
+
+// SnapshotList reports how a list of a snapshot was imported
+type SnapshotList struct {
+	URI         string
+	ID          int //in the snapshot
+	LocalID     int `json:",omitempty"` //in the configuration
+	Fingerprint string
+	Domains     int64
+	Status      string //imported, not configured, no fingerprint, fingerprint mismatch, pin mismatch or missing
+}
+
+type ImportResult struct {
+	Domains int64
+	Lists   []SnapshotList
+}
+
+// exportSnapshot writes the domains and list meta of db to w, from a
+// single transaction
+func exportSnapshot(db *bolt.DB, w io.Writer) error {
+	zw := gzip.NewWriter(w)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(gDomainBucket))
+		header := SnapshotHeader{
+			Format:  gSnapshotFormat,
+			Version: gSnapshotVersion,
+			Created: time.Now().Unix(),
+			Domains: int64(bucket.Stats().KeyN),
+			Meta:    readDBMeta(tx),
+		}
+		line, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		_, err = zw.Write(append(line, '\n'))
+		if err != nil {
+			return err
+		}
+
+		buf := []byte{}
+		err = bucket.ForEach(func(k, v []byte) error {
+			buf = binary.AppendUvarint(buf[:0], uint64(len(k)))
+			buf = append(buf, k...)
+			buf = binary.AppendUvarint(buf, uint64(len(v)))
+			buf = append(buf, v...)
+			_, err := zw.Write(buf)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		_, err = zw.Write([]byte{0})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// copyDB writes db to a temporary file next to it and opens the copy
+// read only. It fails when the disk has no room for the copy.
+func copyDB(db *bolt.DB) (*bolt.DB, error) {
+	f, err := os.CreateTemp(filepath.Dir(db.Path()), filepath.Base(db.Path())+".export-*")
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		err := checkDiskSpace(filepath.Dir(db.Path()), tx.Size())
+		if err != nil {
+			return err
+		}
+		_, err = tx.WriteTo(f)
+		return err
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	copied, err := bolt.Open(f.Name(), 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return copied, nil
+}
+
+func readRecordField(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<16 {
+		return nil, fmt.Errorf("%w: record of %d bytes", ErrSnapshot, n)
+	}
+	field := make([]byte, n)
+	_, err = io.ReadFull(r, field)
+	return field, err
+}
+
+// snapshotListStatus checks the copy of a list in a snapshot against its
+// entry in the configuration. The fingerprint has to be the digest the
+// entry pins, a list fetched compressed has a fingerprint of its content
+// and is downloaded instead. Pins that can't be checked here, a sha256sum
+// URI or a public key, have to be the ones the copy was verified against.
+// A list without pins is taken on its URI alone.
+func snapshotListStatus(entry ListEntry, list ListMeta) string {
+	fingerprint, err := hex.DecodeString(list.Fingerprint)
+	if err != nil || len(fingerprint) != sha256.Size {
+		return "no fingerprint"
+	}
+	if digest, err := hex.DecodeString(entry.SHA256); err == nil && len(digest) == sha256.Size {
+		if !bytes.Equal(digest, fingerprint) {
+			return "fingerprint mismatch"
+		}
+	} else if entry.SHA256 != list.SHA256 {
+		return "pin mismatch"
+	}
+	if entry.PublicKey != list.PublicKey {
+		return "pin mismatch"
+	}
+	return "imported"
+}
+
+// snapshotLists matches the lists of a snapshot with the configured lists
+// by URI and checks their fingerprints. It returns the list ids to import,
+// by their id in the snapshot.
+func (b *Block) snapshotLists(meta DBMeta) (map[int]int, []SnapshotList) {
+	ids := map[int]int{}
+	lists := []SnapshotList{}
+
+	BLmtx.Lock()
+	defer BLmtx.Unlock()
+	b.config.assignListIDs()
+
+	seen := map[string]bool{}
+	for _, list := range meta.Lists {
+		report := SnapshotList{URI: list.URI, ID: list.ID, Fingerprint: list.Fingerprint, Domains: list.Domains, Status: "not configured"}
+		idx := slices.IndexFunc(b.config.BlockLists, func(entry ListEntry) bool { return entry.URI == list.URI })
+		if idx >= 0 {
+			entry := b.config.BlockLists[idx]
+			report.LocalID = entry.ID
+			report.Status = snapshotListStatus(entry, list)
+			if report.Status == "imported" {
+				ids[list.ID] = entry.ID
+			}
+			seen[list.URI] = true
+		}
+		lists = append(lists, report)
+	}
+
+	for _, entry := range b.config.BlockLists {
+		if entry.Enabled && !seen[entry.URI] {
+			lists = append(lists, SnapshotList{URI: entry.URI, LocalID: entry.ID, Status: "missing"})
+		}
+	}
+
+	return ids, lists
+}
+
+// buildSnapshotDB writes the records of r to a new db at path, keeping the
+// lists in ids under their local id
+func buildSnapshotDB(path string, r *bufio.Reader, header SnapshotHeader, ids map[int]int) (int64, error) {
+	os.Remove(path)
+	db, err := boltOpen(path, &bolt.Options{Timeout: 1 * time.Second, NoSync: true})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	err = migrateDB(db)
+	if err != nil {
+		return 0, err
+	}
+
+	type record struct {
+		name  []byte
+		value []byte
+	}
+
+	write := func(records []record) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(gDomainBucket))
+			for _, rec := range records {
+				item := BucketItem{}
+				err := item.DecodeValue(rec.value)
+				if err != nil {
+					return fmt.Errorf("%w: %q: %w", ErrSnapshot, rec.name, err)
+				}
+
+				list_ids := []int{}
+				for _, list_id := range item.Value.List_ids {
+					if local, ok := ids[list_id]; ok {
+						list_ids = append(list_ids, local)
+					}
+				}
+				if len(list_ids) == 0 {
+					continue
+				}
+				slices.Sort(list_ids)
+				item.Value.List_ids = list_ids
+
+				value, err := item.EncodeValue()
+				if err != nil {
+					return err
+				}
+				err = bucket.Put(rec.name, value)
+				if err != nil {
+					return err
+				}
+				for _, list_id := range list_ids {
+					lists, err := createListBucket(tx, list_id)
+					if err != nil {
+						return err
+					}
+					err = lists.Put(rec.name, []byte{})
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	read := int64(0)
+	records := []record{}
+	for {
+		name, err := readRecordField(r)
+		if err != nil {
+			return 0, fmt.Errorf("%w: truncated after %d domains: %w", ErrSnapshot, read, err)
+		}
+		if len(name) == 0 {
+			break
+		}
+		value, err := readRecordField(r)
+		if err != nil {
+			return 0, fmt.Errorf("%w: truncated after %d domains: %w", ErrSnapshot, read, err)
+		}
+		read++
+
+		records = append(records, record{name, value})
+		if len(records) == gListChunk {
+			err = write(records)
+			if err != nil {
+				return 0, err
+			}
+			records = records[:0]
+		}
+	}
+	err = write(records)
+	if err != nil {
+		return 0, err
+	}
+
+	if read != header.Domains {
+		return 0, fmt.Errorf("%w: %d domains, the header says %d", ErrSnapshot, read, header.Domains)
+	}
+
+	for _, list := range header.Meta.Lists {
+		local, ok := ids[list.ID]
+		if !ok {
+			continue
+		}
+		list.ID = local
+		list.Domains = listDomainCount(db, local)
+		err = setListMeta(db, list)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = checkDB(db)
+	if err != nil {
+		return 0, err
+	}
+	return getCount(db, gDomainBucket), db.Sync()
+}
+
+// importSnapshot replaces the live db with the snapshot in r. The lists of
+// the snapshot are matched with the configuration, the others are left
+// out. The snapshot is built into a new file that is swapped in whole, a
+// bad snapshot leaves the live db alone.
+func (b *Block) importSnapshot(r io.Reader) (ImportResult, error) {
+	result := ImportResult{}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return result, fmt.Errorf("%w: %w", ErrSnapshot, err)
+	}
+	br := bufio.NewReader(zr)
+
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return result, fmt.Errorf("%w: no header: %w", ErrSnapshot, err)
+	}
+	header := SnapshotHeader{}
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return result, fmt.Errorf("%w: bad header: %w", ErrSnapshot, err)
+	}
+	if header.Format != gSnapshotFormat {
+		return result, fmt.Errorf("%w: unknown format %q", ErrSnapshot, header.Format)
+	}
+	if header.Version > gSnapshotVersion {
+		return result, fmt.Errorf("%w: version %d is newer than %d", ErrSnapshot, header.Version, gSnapshotVersion)
+	}
+
+	ids, lists := b.snapshotLists(header.Meta)
+	result.Lists = lists
+	if len(ids) == 0 {
+		return result, fmt.Errorf("%w: none of its lists are configured", ErrSnapshot)
+	}
+
+	//a single import at a time, list updates wait until it is swapped in
+	DLmtx.Lock()
+	defer DLmtx.Unlock()
+
+	tmp := b.DbPath + ".import"
+	result.Domains, err = buildSnapshotDB(tmp, br, header, ids)
+	if err != nil {
+		os.Remove(tmp)
+		return result, err
+	}
+
+	Dmtx.Lock()
+	defer Dmtx.Unlock()
+
+	err = b.replaceDBLocked(tmp)
+	if err != nil {
+		return result, err
+	}
+	b.setRebuilding(false)
+	b.rebuildFilterLocked()
+	gMetrics.BlockedDomains.Store(getCount(b.db(), gDomainBucket))
+	b.updateDBMetrics()
+	updateListMetrics(b.db())
+
+	log.Infof("Imported snapshot with %d domains in %d lists", result.Domains, len(ids))
+	return result, nil
+}
+
+func (b *Block) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h := b.acquire()
+		if h == nil {
+			http.Error(w, "database not ready", 400)
+			return
+		}
+		//the client sets the pace of the stream, export from a copy rather
+		//than holding a transaction on the live db that long
+		db, err := copyDB(h.db)
+		h.release()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer os.Remove(db.Path())
+		defer db.Close()
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="block.snapshot"`)
+		err = exportSnapshot(db, w)
+		if err != nil {
+			log.Warningf("Failed to export snapshot: %s", err)
+		}
+		return
+	}
+
+	result, err := b.importSnapshot(r.Body)
+	if err == nil {
+		//the configured lists the snapshot did not provide are downloaded
+		uris := []string{}
+		for _, list := range result.Lists {
+			if list.Status != "imported" && list.Status != "not configured" {
+				uris = append(uris, list.URI)
+			}
+		}
+		if len(uris) > 0 {
+			b.retries.record(b.downloadLists(uris))
+		}
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(struct {
+			Error string
+			ImportResult
+		}{err.Error(), result})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
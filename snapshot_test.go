@@ -0,0 +1,109 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func snapshotList(name string) string {
+	list := ""
+	for i := 0; i < 100; i++ {
+		list += fmt.Sprintf("0.0.0.0 host%d.%s.example.com\n", i, name)
+	}
+	return list + "0.0.0.0 shared.example.com\n"
+}
+
+func TestSnapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(snapshotList(r.URL.Path[1:])))
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/snapshot_src.db")
+	src := New()
+	src.setupDB("/tmp/snapshot_src.db")
+	defer src.closeDB()
+	src.superapi_enabled = true
+	src.config.BlockLists = []ListEntry{
+		{URI: srv.URL + "/ads", Enabled: true},
+		{URI: srv.URL + "/trackers", Enabled: true},
+		{URI: srv.URL + "/pinned", Enabled: true},
+		{URI: srv.URL + "/signed", Enabled: true},
+	}
+	src.downloadLists(nil)
+
+	rr := httptest.NewRecorder()
+	src.snapshotHandler(rr, httptest.NewRequest("GET", "/db/snapshot", nil))
+	snapshot := rr.Body.Bytes()
+
+	//the new instance has the lists under other ids, one list is not in
+	//the snapshot, one is pinned to its content and one to other content
+	os.Remove("/tmp/snapshot_dst.db")
+	dst := New()
+	dst.setupDB("/tmp/snapshot_dst.db")
+	defer dst.closeDB()
+	dst.superapi_enabled = true
+	dst.config.BlockLists = []ListEntry{
+		{URI: srv.URL + "/trackers", Enabled: true, SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(snapshotList("trackers"))))},
+		{URI: srv.URL + "/malware", Enabled: true},
+		{URI: srv.URL + "/ads", Enabled: true},
+		{URI: srv.URL + "/pinned", Enabled: true, SHA256: strings.Repeat("00", sha256.Size)},
+		{URI: srv.URL + "/signed", Enabled: true, PublicKey: "RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3"},
+	}
+
+	//a truncated snapshot leaves the db alone
+	rr = httptest.NewRecorder()
+	dst.snapshotHandler(rr, httptest.NewRequest("PUT", "/db/snapshot", bytes.NewReader(snapshot[:len(snapshot)/2])))
+	if rr.Code != 400 {
+		t.Errorf("expected a truncated snapshot to fail, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	dst.snapshotHandler(rr, httptest.NewRequest("PUT", "/db/snapshot", bytes.NewReader(snapshot)))
+	result := ImportResult{}
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil || rr.Code != 200 {
+		t.Fatalf("import failed %d: %v", rr.Code, err)
+	}
+
+	status := map[string]string{}
+	for _, list := range result.Lists {
+		status[list.URI[len(srv.URL):]] = list.Status
+	}
+	expected := map[string]string{"/ads": "imported", "/trackers": "imported", "/malware": "missing", "/pinned": "fingerprint mismatch", "/signed": "pin mismatch"}
+	for uri, want := range expected {
+		if status[uri] != want {
+			t.Errorf("expected %s to be %s, got %q", uri, want, status[uri])
+		}
+	}
+	if result.Domains != 201 {
+		t.Errorf("expected 201 domains, got %d", result.Domains)
+	}
+
+	//the missing list is downloaded, the mismatched ones fail verification
+	value, found := dst.getDomain("shared.example.com.")
+	if !found || !slices.Equal(value.List_ids, []int{0, 1, 2}) {
+		t.Errorf("expected the list ids to be mapped to the configuration, got %v", value)
+	}
+	if _, found := dst.getDomain("host1.malware.example.com."); !found {
+		t.Errorf("expected the list missing from the snapshot to be downloaded")
+	}
+	if _, found := dst.getDomain("host1.pinned.example.com."); found {
+		t.Errorf("expected the list with a fingerprint mismatch to be left out")
+	}
+	if !listHas(dst.db(), 2, "host1.ads.example.com.") {
+		t.Errorf("expected the list buckets to be rebuilt")
+	}
+
+	meta, _ := getDBMeta(dst.db())
+	if len(meta.Lists) != 3 || meta.Lists[0].ID != 0 || meta.Lists[0].URI != srv.URL+"/trackers" || meta.Lists[0].Domains != 101 {
+		t.Errorf("unexpected list meta after import %+v", meta.Lists)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"maps"
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,11 +27,18 @@ var OLD_CONFIG_PATH = TEST_PREFIX + "/state/dns/block_rules.json"
 var CONFIG_PATH = TEST_PREFIX + "/configs/dns/block_rules.json"
 
 type ListEntry struct {
+	ID        int //stable id the domains of the list are stored under
 	URI       string
 	Enabled   bool
-	Tags      []string //tags for which the list applies to
-	Category  string   //category tag to apply
-	DontBlock bool     //if we only annotate category but do not block.
+	Tags      []string          //tags for which the list applies to
+	Category  string            //category tag to apply
+	DontBlock bool              //if we only annotate category but do not block.
+	SHA256    string            `json:",omitempty"` //hex digest or URI of a sha256sum file the list must match
+	PublicKey string            `json:",omitempty"` //minisign or base64 ed25519 key, signature fetched from URI.minisig or URI.sig
+	Limits    *ListLimits       `json:",omitempty"` //overrides the configured ListLimits for this list
+	Headers   map[string]string `json:",omitempty"` //extra request headers, secrets belong in the list credentials
+	Proxy     string            `json:",omitempty"` //proxy URL for this list, overrides the configured Proxy
+	Mirrors   []string          `json:",omitempty"` //tried in order when URI fails
 }
 
 type DomainOverride struct {
@@ -61,12 +70,26 @@ type SPRBlockConfigOld struct {
 }
 
 type SPRBlockConfig struct {
-	BlockLists            []ListEntry //list of URIs with DNS block lists
-	OverrideLists         []OverrideList
-	ClientIPExclusions    []string //these IPs should not have ad blocking
-	RefreshSeconds        int
-	QuarantineHostIP      string //for devices in quarantine mode
-	RebindingCheckDisable bool
+	BlockLists               []ListEntry //list of URIs with DNS block lists
+	OverrideLists            []OverrideList
+	ClientIPExclusions       []string //these IPs should not have ad blocking
+	RefreshSeconds           int
+	QuarantineHostIP         string //for devices in quarantine mode
+	RebindingCheckDisable    bool
+	DownloadWorkers          int          `json:",omitempty"` //lists downloaded in parallel, defaults to 4
+	ListLimits               *ListLimits  `json:",omitempty"` //limits for each list
+	TotalLimits              *ListLimits  `json:",omitempty"` //limits for all lists of a refresh together
+	Proxy                    string       `json:",omitempty"` //proxy URL for list downloads
+	NextListID               int          `json:",omitempty"` //ids of deleted lists are not given out again
+	DomainStore              string       `json:",omitempty"` //"bolt" (default) or "memory" for lookups from an in-memory trie
+	FailClosed               bool         `json:",omitempty"` //block all lookups while a corrupt db is rebuilt
+	CompactSeconds           int          `json:",omitempty"` //time between compactions of the db, defaults to a week
+	CompactFreeRatio         float64      `json:",omitempty"` //compact after a refresh leaves more of the db free, defaults to 0.5
+	QueryLog                 bool         `json:",omitempty"` //keep a log of queries for /querylog
+	QueryLogMaxEntries       int          `json:",omitempty"` //defaults to 100000
+	QueryLogRetentionSeconds int          `json:",omitempty"` //defaults to a week
+	EventTopics              *EventTopics `json:",omitempty"` //sprbus topics of the events, - to turn one off
+	Dnstap                   string       `json:",omitempty"` //unix:///path of a socket or a file for dnstap messages of synthesized responses
 }
 
 var Configmtx sync.Mutex
@@ -128,6 +151,27 @@ func (b *Block) loadSPRConfig() {
 	if err != nil {
 		fmt.Println(err)
 	}
+	BLmtx.Lock()
+	b.config.assignListIDs()
+	BLmtx.Unlock()
+}
+
+// assignListIDs gives every list without an id of its own a new one. Lists
+// from configs before ids existed all have 0, they get their index, which is
+// the id their domains were stored under.
+func (c *SPRBlockConfig) assignListIDs() {
+	for _, entry := range c.BlockLists {
+		c.NextListID = max(c.NextListID, entry.ID+1)
+	}
+
+	seen := map[int]bool{}
+	for i := range c.BlockLists {
+		if seen[c.BlockLists[i].ID] || c.BlockLists[i].ID < 0 {
+			c.BlockLists[i].ID = c.NextListID
+			c.NextListID++
+		}
+		seen[c.BlockLists[i].ID] = true
+	}
 }
 
 func (b *Block) saveConfigLocked() {
@@ -362,13 +406,23 @@ func (b *Block) modifyBlockLists(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodPut {
 		found := false
+		changed := true
 		BLmtx.Lock()
 		for i, _ := range b.config.BlockLists {
 			if b.config.BlockLists[i].URI == entry.URI {
+				changed = !b.config.BlockLists[i].sameSource(entry)
+				entry.ID = b.config.BlockLists[i].ID
+
 				b.config.BlockLists[i].Enabled = entry.Enabled
 				b.config.BlockLists[i].Tags = entry.Tags
 				b.config.BlockLists[i].DontBlock = entry.DontBlock
 				b.config.BlockLists[i].Category = entry.Category
+				b.config.BlockLists[i].SHA256 = entry.SHA256
+				b.config.BlockLists[i].PublicKey = entry.PublicKey
+				b.config.BlockLists[i].Limits = entry.Limits
+				b.config.BlockLists[i].Headers = entry.Headers
+				b.config.BlockLists[i].Proxy = entry.Proxy
+				b.config.BlockLists[i].Mirrors = entry.Mirrors
 
 				found = true
 				break
@@ -376,13 +430,19 @@ func (b *Block) modifyBlockLists(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if !found {
+			b.config.assignListIDs()
+			entry.ID = b.config.NextListID
+			b.config.NextListID++
 			b.config.BlockLists = append(b.config.BlockLists, entry)
 		}
 		BLmtx.Unlock()
 
 		b.saveConfig()
-		//update the download
-		b.download()
+		//disabled lists stay stored, only a list without data or fetched
+		//differently is downloaded again. the rest applies at lookup time
+		if entry.Enabled && (changed || !b.hasListData(entry.ID)) {
+			go b.downloadList(entry.URI)
+		}
 	} else if r.Method == http.MethodDelete {
 		found := -1
 		BLmtx.Lock()
@@ -402,7 +462,7 @@ func (b *Block) modifyBlockLists(w http.ResponseWriter, r *http.Request) {
 		b.config.BlockLists = append(b.config.BlockLists[:found], b.config.BlockLists[found+1:]...)
 		BLmtx.Unlock()
 		b.saveConfig()
-		b.download()
+		go b.collectGarbage()
 
 	}
 
@@ -412,6 +472,30 @@ func (b *Block) modifyBlockLists(w http.ResponseWriter, r *http.Request) {
 	BLmtx.RUnlock()
 }
 
+// sameSource reports if entry is downloaded the same way as other
+func (entry ListEntry) sameSource(other ListEntry) bool {
+	return entry.URI == other.URI &&
+		entry.SHA256 == other.SHA256 &&
+		entry.PublicKey == other.PublicKey &&
+		entry.Limits.merge(ListLimits{}) == other.Limits.merge(ListLimits{}) &&
+		maps.Equal(entry.Headers, other.Headers) &&
+		entry.Proxy == other.Proxy &&
+		slices.Equal(entry.Mirrors, other.Mirrors)
+}
+
+func (b *Block) getBlockListStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := []ListStatus{}
+
+	BLmtx.RLock()
+	for _, entry := range b.config.BlockLists {
+		statuses = append(statuses, getListStatus(entry.URI))
+	}
+	BLmtx.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
 func (b *Block) modifyExclusions(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodGet {
@@ -473,9 +557,13 @@ func (b *Block) modifyExclusions(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// getMetrics reports the metrics, a DELETE resets the counters first
 func (b *Block) getMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		gMetrics.reset()
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(gMetrics)
+	json.NewEncoder(w).Encode(gMetrics.snapshot())
 }
 
 func (b *Block) setRefresh(w http.ResponseWriter, r *http.Request) {
@@ -510,10 +598,8 @@ func logRequest(handler http.Handler) http.Handler {
 	})
 }
 
+// runAPI serves the plugin API, the configuration is expected to be loaded
 func (b *Block) runAPI() {
-	b.MigrateConfig()
-	b.loadSPRConfig()
-
 	unix_plugin_router := mux.NewRouter().StrictSlash(true)
 
 	unix_plugin_router.HandleFunc("/config", b.showConfig).Methods("GET")
@@ -523,9 +609,19 @@ func (b *Block) runAPI() {
 	unix_plugin_router.HandleFunc("/overrideList/{list}", b.modifyOverrideList).Methods("PUT", "DELETE")
 	unix_plugin_router.HandleFunc("/quarantineHost", b.quarantineHost).Methods("PUT", "DELETE")
 	unix_plugin_router.HandleFunc("/blocklists", b.modifyBlockLists).Methods("GET", "PUT", "DELETE")
+	unix_plugin_router.HandleFunc("/blocklists/status", b.getBlockListStatus).Methods("GET")
+	unix_plugin_router.HandleFunc("/blocklists/credentials", b.modifyListCredentials).Methods("GET", "PUT", "DELETE")
 	unix_plugin_router.HandleFunc("/exclusions", b.modifyExclusions).Methods("GET", "PUT", "DELETE")
 	unix_plugin_router.HandleFunc("/dump_domains", b.dumpEntries).Methods("GET")
-	unix_plugin_router.HandleFunc("/metrics", b.getMetrics).Methods("GET")
+	unix_plugin_router.HandleFunc("/domains", b.listDomains).Methods("GET")
+	unix_plugin_router.HandleFunc("/domains/{domain}", b.showDomain).Methods("GET")
+	unix_plugin_router.HandleFunc("/explain", b.explainLookup).Methods("GET")
+	unix_plugin_router.HandleFunc("/querylog", b.searchQueryLog).Methods("GET")
+	unix_plugin_router.HandleFunc("/stats/top", b.getTopStats).Methods("GET")
+	unix_plugin_router.HandleFunc("/metrics", b.getMetrics).Methods("GET", "DELETE")
+	unix_plugin_router.HandleFunc("/db/meta", b.showDBMeta).Methods("GET")
+	unix_plugin_router.HandleFunc("/db/compact", b.compactHandler).Methods("PUT")
+	unix_plugin_router.HandleFunc("/db/snapshot", b.snapshotHandler).Methods("GET", "PUT")
 
 	os.Remove(UNIX_PLUGIN_LISTENER)
 	unixPluginListener, err := net.Listen("unix", UNIX_PLUGIN_LISTENER)
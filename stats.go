@@ -0,0 +1,310 @@
+package block
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// counters kept per sketch. Keys past the capacity replace the smallest
+// counter, so memory stays bounded and a key seen more than 1/capacity of
+// the time is always kept.
+var gStatsCapacity = 128
+
+// blocks are counted in 5 minute buckets for the last hour and in hourly
+// buckets for the last week
+var gStatsFineWidth = 5 * time.Minute
+var gStatsCoarseWidth = time.Hour
+
+var gStatsWindows = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+var gStatsSaveInterval = 5 * time.Minute
+
+// TopEntry is a heavy hitter. Count may be over by up to Error.
+type TopEntry struct {
+	Key   string
+	Count int64
+	Error int64
+}
+
+// spaceSaving is a Space-Saving heavy hitter sketch
+type spaceSaving struct {
+	counters map[string]*TopEntry
+}
+
+func newSpaceSaving() *spaceSaving {
+	return &spaceSaving{counters: map[string]*TopEntry{}}
+}
+
+func (s *spaceSaving) add(key string) {
+	if c, ok := s.counters[key]; ok {
+		c.Count++
+		return
+	}
+	if len(s.counters) < gStatsCapacity {
+		s.counters[key] = &TopEntry{key, 1, 0}
+		return
+	}
+
+	var smallest *TopEntry
+	for _, c := range s.counters {
+		if smallest == nil || c.Count < smallest.Count {
+			smallest = c
+		}
+	}
+	delete(s.counters, smallest.Key)
+	s.counters[key] = &TopEntry{key, smallest.Count + 1, smallest.Count}
+}
+
+func (s *spaceSaving) MarshalJSON() ([]byte, error) {
+	entries := []TopEntry{}
+	for _, c := range s.counters {
+		entries = append(entries, *c)
+	}
+	slices.SortFunc(entries, func(a, b TopEntry) int { return strings.Compare(a.Key, b.Key) })
+	return json.Marshal(entries)
+}
+
+func (s *spaceSaving) UnmarshalJSON(data []byte) error {
+	entries := []TopEntry{}
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+	s.counters = map[string]*TopEntry{}
+	for _, entry := range entries {
+		s.counters[entry.Key] = &entry
+	}
+	return nil
+}
+
+// topN merges sketches and returns the n largest counts
+func topN(sketches []*spaceSaving, n int) []TopEntry {
+	merged := map[string]*TopEntry{}
+	for _, s := range sketches {
+		for key, c := range s.counters {
+			if m, ok := merged[key]; ok {
+				m.Count += c.Count
+				m.Error += c.Error
+			} else {
+				merged[key] = &TopEntry{key, c.Count, c.Error}
+			}
+		}
+	}
+
+	entries := []TopEntry{}
+	for _, m := range merged {
+		entries = append(entries, *m)
+	}
+	slices.SortFunc(entries, func(a, b TopEntry) int {
+		if a.Count != b.Count {
+			return cmp.Compare(b.Count, a.Count)
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries[:min(n, len(entries))]
+}
+
+type statsBucket struct {
+	Start      int64 //unix time
+	Blocked    int64
+	Domains    *spaceSaving
+	Clients    *spaceSaving
+	Categories *spaceSaving
+}
+
+// topStats counts blocked queries by domain, client and category
+type topStats struct {
+	mtx    sync.Mutex
+	Fine   []*statsBucket
+	Coarse []*statsBucket
+}
+
+func newTopStats() *topStats {
+	return &topStats{Fine: []*statsBucket{}, Coarse: []*statsBucket{}}
+}
+
+// current returns the bucket of width for now, dropping buckets older than
+// keep
+func current(buckets []*statsBucket, now time.Time, width time.Duration, keep time.Duration) ([]*statsBucket, *statsBucket) {
+	start := now.Truncate(width).Unix()
+	oldest := now.Add(-keep).Unix()
+	for len(buckets) > 0 && buckets[0].Start < oldest {
+		buckets = buckets[1:]
+	}
+
+	if len(buckets) > 0 && buckets[len(buckets)-1].Start == start {
+		return buckets, buckets[len(buckets)-1]
+	}
+	bucket := &statsBucket{
+		Start:      start,
+		Domains:    newSpaceSaving(),
+		Clients:    newSpaceSaving(),
+		Categories: newSpaceSaving(),
+	}
+	return append(buckets, bucket), bucket
+}
+
+func (s *topStats) record(now time.Time, client string, name string, categories []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var fine, coarse *statsBucket
+	s.Fine, fine = current(s.Fine, now, gStatsFineWidth, gStatsWindows["hour"]+gStatsFineWidth)
+	s.Coarse, coarse = current(s.Coarse, now, gStatsCoarseWidth, gStatsWindows["week"]+gStatsCoarseWidth)
+
+	for _, bucket := range []*statsBucket{fine, coarse} {
+		bucket.Blocked++
+		bucket.Domains.add(name)
+		bucket.Clients.add(client)
+		for _, category := range categories {
+			bucket.Categories.add(category)
+		}
+	}
+}
+
+type TopStats struct {
+	Window     string
+	Since      int64 //unix time the first bucket counted starts
+	Blocked    int64
+	Domains    []TopEntry
+	Clients    []TopEntry
+	Categories []TopEntry
+}
+
+// top returns the n most blocked domains, clients and categories of
+// window. The window is rounded out to whole buckets.
+func (s *topStats) top(window string, n int, now time.Time) TopStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	buckets, width := s.Coarse, gStatsCoarseWidth
+	if window == "hour" {
+		buckets, width = s.Fine, gStatsFineWidth
+	}
+	since := now.Add(-gStatsWindows[window]).Truncate(width).Unix()
+
+	result := TopStats{Window: window, Since: since}
+	domains, clients, categories := []*spaceSaving{}, []*spaceSaving{}, []*spaceSaving{}
+	for _, bucket := range buckets {
+		if bucket.Start < since {
+			continue
+		}
+		result.Blocked += bucket.Blocked
+		domains = append(domains, bucket.Domains)
+		clients = append(clients, bucket.Clients)
+		categories = append(categories, bucket.Categories)
+	}
+	result.Domains = topN(domains, n)
+	result.Clients = topN(clients, n)
+	result.Categories = topN(categories, n)
+	return result
+}
+
+// save writes the counts to filename, through a synced temporary file so a
+// crash keeps the previous copy
+func (s *topStats) save(filename string) error {
+	s.mtx.Lock()
+	data, err := json.Marshal(s)
+	s.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (s *topStats) load(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	loaded := newTopStats()
+	err = json.Unmarshal(data, loaded)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	s.Fine, s.Coarse = loaded.Fine, loaded.Coarse
+	s.mtx.Unlock()
+	return nil
+}
+
+func (b *Block) statsPath() string {
+	return b.DbPath + "-stats"
+}
+
+// loadStats loads the counts saved by the last run. It replaces the counts,
+// so it runs before queries are answered.
+func (b *Block) loadStats() {
+	err := b.stats.load(b.statsPath())
+	if err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to load statistics: %s", err)
+	}
+}
+
+// persistStats saves the counts every gStatsSaveInterval and once more when
+// b.stop is closed
+func (b *Block) persistStats() {
+	tick := time.NewTicker(gStatsSaveInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-b.stop:
+			b.stats.save(b.statsPath())
+			return
+		}
+		err := b.stats.save(b.statsPath())
+		if err != nil {
+			log.Warningf("Failed to save statistics: %s", err)
+		}
+	}
+}
+
+func (b *Block) getTopStats(w http.ResponseWriter, r *http.Request) {
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "day"
+	}
+	if _, ok := gStatsWindows[window]; !ok {
+		http.Error(w, "window must be hour, day or week", 400)
+		return
+	}
+
+	n := 10
+	if count := r.URL.Query().Get("n"); count != "" {
+		i, err := strconv.Atoi(count)
+		if err != nil || i <= 0 {
+			http.Error(w, "invalid n", 400)
+			return
+		}
+		n = min(i, gStatsCapacity)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.stats.top(window, n, time.Now()))
+}
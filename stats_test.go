@@ -0,0 +1,111 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	s := newSpaceSaving()
+	for i := 0; i < 5000; i++ {
+		s.add(fmt.Sprintf("rare%d.example.com.", i))
+		if i%5 == 0 {
+			s.add("heavy.example.com.")
+		}
+	}
+
+	if len(s.counters) > gStatsCapacity {
+		t.Errorf("sketch grew to %d counters", len(s.counters))
+	}
+	top := topN([]*spaceSaving{s}, 1)
+	if len(top) != 1 || top[0].Key != "heavy.example.com." || top[0].Count < 1000 || top[0].Count-top[0].Error > 1000 {
+		t.Errorf("expected heavy.example.com. on top with a count bound of 1000, got %+v", top)
+	}
+}
+
+func keys(entries []TopEntry) []string {
+	k := []string{}
+	for _, entry := range entries {
+		k = append(k, entry.Key)
+	}
+	return k
+}
+
+func TestTopStats(t *testing.T) {
+	now := time.Now()
+	s := newTopStats()
+	for i := 0; i < 3; i++ {
+		s.record(now.Add(-20*time.Minute), "192.168.2.10", "a.example.com.", []string{"ads"})
+	}
+	for i := 0; i < 4; i++ {
+		s.record(now.Add(-3*time.Hour), "192.168.2.11", "b.example.com.", []string{"malware"})
+	}
+	s.record(now.Add(-3*24*time.Hour), "192.168.2.12", "c.example.com.", nil)
+	s.record(now.Add(-30*24*time.Hour), "192.168.2.13", "d.example.com.", nil)
+
+	for _, test := range []struct {
+		window     string
+		blocked    int64
+		domains    []string
+		categories []string
+	}{
+		{"hour", 3, []string{"a.example.com."}, []string{"ads"}},
+		{"day", 7, []string{"b.example.com.", "a.example.com."}, []string{"malware", "ads"}},
+		{"week", 8, []string{"b.example.com.", "a.example.com.", "c.example.com."}, []string{"malware", "ads"}},
+	} {
+		top := s.top(test.window, 10, now)
+		if top.Blocked != test.blocked || !slices.Equal(keys(top.Domains), test.domains) || !slices.Equal(keys(top.Categories), test.categories) {
+			t.Errorf("%s: unexpected %+v", test.window, top)
+		}
+	}
+	if clients := s.top("day", 1, now).Clients; len(clients) != 1 || clients[0].Key != "192.168.2.11" || clients[0].Count != 4 {
+		t.Errorf("unexpected top client %+v", clients)
+	}
+
+	//counts survive a restart
+	os.Remove("/tmp/stats_test.json")
+	if err := s.save("/tmp/stats_test.json"); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newTopStats()
+	if err := loaded.load("/tmp/stats_test.json"); err != nil {
+		t.Fatal(err)
+	}
+	before, after := s.top("week", 10, now), loaded.top("week", 10, now)
+	if !slices.Equal(before.Domains, after.Domains) || before.Blocked != after.Blocked {
+		t.Errorf("expected the same counts after loading, got %+v and %+v", before, after)
+	}
+}
+
+func TestTopStatsAPI(t *testing.T) {
+	b, _ := newTestBlock(t, "0.0.0.0 ads.example.com\n", nil)
+
+	for _, name := range []string{"www.ads.example.com.", "ads.example.com.", "good.example.org."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		b.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	}
+
+	rr := httptest.NewRecorder()
+	b.getTopStats(rr, httptest.NewRequest("GET", "/stats/top?window=hour&n=5", nil))
+	top := TopStats{}
+	json.NewDecoder(rr.Body).Decode(&top)
+	if top.Blocked != 2 || len(top.Domains) != 2 || !slices.Equal(keys(top.Categories), []string{"ads"}) || top.Clients[0].Count != 2 {
+		t.Errorf("unexpected stats %+v", top)
+	}
+
+	rr = httptest.NewRecorder()
+	b.getTopStats(rr, httptest.NewRequest("GET", "/stats/top?window=year", nil))
+	if rr.Code != 400 {
+		t.Errorf("expected an unknown window to fail, got %d", rr.Code)
+	}
+}
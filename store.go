@@ -0,0 +1,101 @@
+package block
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// DomainStore answers domain lookups. The bolt db is always the source of
+// truth, writes go through to it and a store may keep its own index on top.
+type DomainStore interface {
+	// Get returns the value stored for the fully qualified name
+	Get(name string) (DomainValue, bool)
+	// StoreBatch adds list_id to domains[:idx]
+	StoreBatch(domains []string, idx int, list_id int) error
+	// Update replaces the values of the domains in update
+	Update(update map[string]DomainValue) error
+	// Reload picks up domains that were patched in the db directly
+	Reload(domains [][]byte) error
+}
+
+// DomainStore kinds selectable in the configuration
+var (
+	gBoltStore   = "bolt"
+	gMemoryStore = "memory"
+)
+
+// boltStore looks every domain up in the db
+type boltStore struct {
+	db *bolt.DB
+}
+
+func (s *boltStore) Get(name string) (DomainValue, bool) {
+	err, item := getItem(s.db, gDomainBucket, name)
+	if err == nil {
+		return item.Value, true
+	}
+	return DomainValue{}, false
+}
+
+func (s *boltStore) StoreBatch(domains []string, idx int, list_id int) error {
+	return storeBatch(s.db, domains, idx, list_id)
+}
+
+func (s *boltStore) Update(update map[string]DomainValue) error {
+	return updateDomains(s.db, update)
+}
+
+func (s *boltStore) Reload(domains [][]byte) error {
+	return nil
+}
+
+// openStore returns a store of kind on top of db, the bolt store unless
+// kind is gMemoryStore
+func openStore(db *bolt.DB, kind string) (DomainStore, error) {
+	if kind == gMemoryStore {
+		return newMemStore(db)
+	}
+	return &boltStore{db}, nil
+}
+
+// configuredStoreKind returns the DomainStore kind of the configuration
+func (b *Block) configuredStoreKind() string {
+	if b.config.DomainStore == gMemoryStore {
+		return gMemoryStore
+	}
+	return gBoltStore
+}
+
+// withStore returns a handle on ref with a store of kind, the bolt store
+// if kind fails to open
+func withStore(ref *dbRef, kind string) *dbHandle {
+	store, err := openStore(ref.db, kind)
+	if err != nil {
+		log.Warningf("Failed to open %s domain store: %s", kind, err)
+		store, kind = &boltStore{ref.db}, gBoltStore
+	}
+	log.Infof("Using %s domain store", kind)
+	return &dbHandle{ref, store, kind}
+}
+
+// selectStore switches to the DomainStore of the configuration
+func (b *Block) selectStore() {
+	Dmtx.Lock()
+	defer Dmtx.Unlock()
+	b.selectStoreLocked()
+}
+
+func (b *Block) selectStoreLocked() {
+	h := b.active.Load()
+	kind := b.configuredStoreKind()
+	if h == nil || kind == h.kind {
+		return
+	}
+
+	store, err := openStore(h.db, kind)
+	if err != nil {
+		log.Warningf("Failed to open %s domain store, keeping %s: %s", kind, h.kind, err)
+		return
+	}
+	b.publish(&dbHandle{h.dbRef, store, kind})
+	log.Infof("Using %s domain store", kind)
+}
@@ -0,0 +1,218 @@
+package block
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// checkTrie verifies that no node below the root is empty or could be
+// merged with its only child
+func checkTrie(t *testing.T, n *trieNode, root bool) {
+	if !root && n.value == nil && len(n.children) < 2 {
+		t.Fatalf("node %v with %d children is not compact", n.edge, len(n.children))
+	}
+	for i, c := range n.children {
+		if i > 0 && n.children[i-1].edge[0] >= c.edge[0] {
+			t.Fatalf("children of %v are not sorted", n.edge)
+		}
+		checkTrie(t, c, false)
+	}
+}
+
+func TestTrie(t *testing.T) {
+	labels := []string{"com", "org", "example", "www", "ads", "a", "b"}
+	names := []string{}
+	for i := 0; i < 500; i++ {
+		name := ""
+		for j := 0; j <= rand.IntN(4); j++ {
+			name += labels[rand.IntN(len(labels))] + "."
+		}
+		names = append(names, name)
+	}
+
+	root := &trieNode{}
+	expected := map[string]*DomainValue{}
+	for i := 0; i < 5000; i++ {
+		name := names[rand.IntN(len(names))]
+		if rand.IntN(3) == 0 {
+			_, exists := expected[name]
+			if root.remove(reversedLabels(name)) != exists {
+				t.Fatalf("remove of %s disagrees with map", name)
+			}
+			delete(expected, name)
+		} else {
+			value := &DomainValue{List_ids: []int{i}}
+			_, exists := expected[name]
+			if root.insert(reversedLabels(name), value) == exists {
+				t.Fatalf("insert of %s disagrees with map", name)
+			}
+			expected[name] = value
+		}
+		checkTrie(t, root, true)
+	}
+
+	for _, name := range names {
+		if got := root.get(reversedLabels(name)); got != expected[name] {
+			t.Errorf("%s: expected %v, got %v", name, expected[name], got)
+		}
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	os.Remove("/tmp/store_test.db")
+	os.Remove("/tmp/store_staging.db")
+	db := BoltOpen("/tmp/store_test.db")
+	defer db.Close()
+	staging := BoltOpen("/tmp/store_staging.db")
+	defer staging.Close()
+
+	storeBatch(db, []string{"loaded.example.com.", "shared.example.com."}, 2, 0)
+
+	store, err := newMemStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := store.Get("loaded.example.com."); !found {
+		t.Errorf("expected loaded.example.com. from the db")
+	}
+
+	store.StoreBatch([]string{"stored.example.com.", "shared.example.com."}, 2, 1)
+	value, found := store.Get("shared.example.com.")
+	if !found || !slices.Equal(value.List_ids, []int{0, 1}) {
+		t.Errorf("expected shared.example.com. in both lists, got %v", value.List_ids)
+	}
+
+	storeListBatch(staging, []string{"patched.example.com."}, 1, 0)
+	applyList(db, staging, 0, store.Reload)
+	if _, found := store.Get("loaded.example.com."); found {
+		t.Errorf("expected loaded.example.com. to be gone after the patch")
+	}
+	if _, found := store.Get("patched.example.com."); !found {
+		t.Errorf("expected patched.example.com. after the patch")
+	}
+
+	dropList(db, 1, store.Reload)
+	if _, found := store.Get("stored.example.com."); found {
+		t.Errorf("expected stored.example.com. to be dropped")
+	}
+
+	store.Update(map[string]DomainValue{"updated.example.com.": {List_ids: []int{2}}})
+	if _, found := store.Get("updated.example.com."); !found {
+		t.Errorf("expected updated.example.com.")
+	}
+}
+
+func TestSelectMemoryStore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0.0.0.0 ads.example.com\n"))
+	}))
+	defer srv.Close()
+
+	os.Remove("/tmp/store_select.db")
+	b := New()
+	b.setupDB("/tmp/store_select.db")
+	defer b.closeDB()
+	b.superapi_enabled = true
+	b.config.DomainStore = gMemoryStore
+	b.config.BlockLists = []ListEntry{{URI: srv.URL + "/ads", Enabled: true}}
+
+	b.selectStore()
+	if _, ok := b.domainStore().(*memStore); !ok {
+		t.Fatalf("expected the memory store, got %T", b.domainStore())
+	}
+
+	b.downloadLists(nil)
+
+	retIP, retCNAME := "", ""
+	hasPermit := false
+	categories := []string{}
+	if !b.blocked("1.2.3.4", "www.ads.example.com.", &retIP, &retCNAME, &hasPermit, &categories) {
+		t.Errorf("expected www.ads.example.com. to be blocked from the memory store")
+	}
+}
+
+func benchmarkDB(b *testing.B, n int) *bolt.DB {
+	path := fmt.Sprintf("/tmp/store_bench_%d.db", n)
+	_, err := os.Stat(path)
+	db := BoltOpen(path)
+	if err == nil {
+		return db
+	}
+
+	batch := make([]string, 0, 16384)
+	for i := 0; i < n; i++ {
+		batch = append(batch, fmt.Sprintf("host%d.domain%d.com.", i%7, i))
+		if len(batch) == cap(batch) {
+			storeBatch(db, batch, len(batch), i%3)
+			batch = batch[:0]
+		}
+	}
+	storeBatch(db, batch, len(batch), 0)
+	return db
+}
+
+// benchmarkLookups walks the labels of a query like blocked does, one in
+// eight queries is a hit
+func benchmarkLookups(b *testing.B, store DomainStore, n int) {
+	queries := []string{}
+	for i := 0; i < 1024; i++ {
+		if i%8 == 0 {
+			d := rand.IntN(n)
+			queries = append(queries, fmt.Sprintf("www.host%d.domain%d.com.", d%7, d))
+		} else {
+			queries = append(queries, fmt.Sprintf("www.cdn%d.example%d.net.", i, i))
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := queries[i%len(queries)]
+		for _, fullname := range walkLabels(name) {
+			if _, found := store.Get(fullname); found {
+				break
+			}
+		}
+	}
+}
+
+func walkLabels(name string) []string {
+	names := []string{}
+	for i := 0; i < len(name)-1; i++ {
+		if i == 0 || name[i-1] == '.' {
+			names = append(names, name[i:])
+		}
+	}
+	return names
+}
+
+func BenchmarkDomainStore(b *testing.B) {
+	n := 200000
+	db := benchmarkDB(b, n)
+	defer db.Close()
+
+	b.Run("bolt", func(b *testing.B) {
+		benchmarkLookups(b, &boltStore{db}, n)
+	})
+
+	b.Run("memory", func(b *testing.B) {
+		store, err := newMemStore(db)
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkLookups(b, store, n)
+	})
+
+	b.Run("memory-load", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			newMemStore(db)
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package block
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// trieNode is a node of a radix trie over the labels of domains, top level
+// domain first. Chains of nodes without a value and with a single child
+// are merged into one edge, so names below a shared suffix like
+// "co.uk." cost one node each.
+type trieNode struct {
+	edge     []string    //labels from the parent to this node
+	children []*trieNode //sorted by the first label of their edge
+	value    *DomainValue
+}
+
+// reversedLabels splits a fully qualified name into its labels, top level
+// domain first
+func reversedLabels(name string) []string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	slices.Reverse(labels)
+	return labels
+}
+
+func (n *trieNode) child(label string) (int, bool) {
+	return slices.BinarySearchFunc(n.children, label, func(c *trieNode, label string) int {
+		return strings.Compare(c.edge[0], label)
+	})
+}
+
+func commonLabels(a []string, b []string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func (n *trieNode) get(labels []string) *DomainValue {
+	for len(labels) > 0 {
+		i, found := n.child(labels[0])
+		if !found {
+			return nil
+		}
+		c := n.children[i]
+		if len(labels) < len(c.edge) || commonLabels(c.edge, labels) != len(c.edge) {
+			return nil
+		}
+		labels = labels[len(c.edge):]
+		n = c
+	}
+	return n.value
+}
+
+// insert sets the value of labels, returning if they are new to the trie
+func (n *trieNode) insert(labels []string, value *DomainValue) bool {
+	for len(labels) > 0 {
+		i, found := n.child(labels[0])
+		if !found {
+			n.children = slices.Insert(n.children, i, &trieNode{edge: labels, value: value})
+			return true
+		}
+
+		c := n.children[i]
+		common := commonLabels(c.edge, labels)
+		if common < len(c.edge) {
+			//split the edge where labels branch off
+			mid := &trieNode{edge: c.edge[:common], children: []*trieNode{c}}
+			c.edge = c.edge[common:]
+			n.children[i] = mid
+			c = mid
+		}
+		labels = labels[common:]
+		n = c
+	}
+
+	added := n.value == nil
+	n.value = value
+	return added
+}
+
+// remove drops the value of labels, returning if it was in the trie
+func (n *trieNode) remove(labels []string) bool {
+	path := []*trieNode{n}
+	for len(labels) > 0 {
+		i, found := n.child(labels[0])
+		if !found {
+			return false
+		}
+		c := n.children[i]
+		if len(labels) < len(c.edge) || commonLabels(c.edge, labels) != len(c.edge) {
+			return false
+		}
+		labels = labels[len(c.edge):]
+		n = c
+		path = append(path, n)
+	}
+
+	if n.value == nil {
+		return false
+	}
+	n.value = nil
+
+	//unlink empty nodes and merge nodes left with a single child, the
+	//root keeps its empty edge
+	for i := len(path) - 1; i > 0; i-- {
+		node, parent := path[i], path[i-1]
+		if node.value != nil {
+			break
+		}
+		if len(node.children) == 0 {
+			j, _ := parent.child(node.edge[0])
+			parent.children = slices.Delete(parent.children, j, j+1)
+			continue
+		}
+		if len(node.children) == 1 {
+			c := node.children[0]
+			node.edge = append(slices.Clip(node.edge), c.edge...)
+			node.children = c.children
+			node.value = c.value
+		}
+		break
+	}
+	return true
+}
+
+// memStore keeps all domains in a trie in memory, loaded from the db.
+// Lookups never touch the db.
+type memStore struct {
+	db *bolt.DB
+
+	mtx    sync.RWMutex
+	root   *trieNode
+	values map[string]*DomainValue //values shared by all domains with the same lists
+}
+
+func newMemStore(db *bolt.DB) (*memStore, error) {
+	s := &memStore{db: db, root: &trieNode{}, values: map[string]*DomainValue{}}
+
+	type entry struct {
+		labels []string
+		value  *DomainValue
+	}
+	entries := []entry{}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(gDomainBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			item := BucketItem{}
+			if item.DecodeValue(v) == nil {
+				entries = append(entries, entry{reversedLabels(string(k)), s.intern(item.Value)})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//in label order every insert appends to the children, nodes like "com."
+	//have a child for most domains
+	slices.SortFunc(entries, func(a, b entry) int {
+		return slices.Compare(a.labels, b.labels)
+	})
+	for _, e := range entries {
+		s.root.insert(e.labels, e.value)
+	}
+	return s, nil
+}
+
+// intern returns the shared copy of value, with the mutex held
+func (s *memStore) intern(value DomainValue) *DomainValue {
+	item := BucketItem{Value: value}
+	key, _ := item.EncodeValue()
+
+	shared, exists := s.values[string(key)]
+	if !exists {
+		shared = &DomainValue{slices.Clone(value.List_ids), value.Disabled}
+		s.values[string(key)] = shared
+	}
+	return shared
+}
+
+func (s *memStore) Get(name string) (DomainValue, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	value := s.root.get(reversedLabels(name))
+	if value == nil {
+		return DomainValue{}, false
+	}
+	//interned values are never modified, sharing List_ids is safe
+	return *value, true
+}
+
+func (s *memStore) StoreBatch(domains []string, idx int, list_id int) error {
+	err := storeBatch(s.db, domains, idx, list_id)
+	if err != nil {
+		return err
+	}
+
+	keys := make([][]byte, idx)
+	for i, domain := range domains[:idx] {
+		keys[i] = []byte(domain)
+	}
+	return s.Reload(keys)
+}
+
+func (s *memStore) Update(update map[string]DomainValue) error {
+	err := updateDomains(s.db, update)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for domain, value := range update {
+		if domain != "" {
+			s.root.insert(reversedLabels(domain), s.intern(value))
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Reload(domains [][]byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(gDomainBucket))
+		if bucket == nil {
+			return ErrBucketMissing
+		}
+		for _, domain := range domains {
+			labels := reversedLabels(string(domain))
+			item := BucketItem{}
+			v := bucket.Get(domain)
+			if v == nil || item.DecodeValue(v) != nil {
+				s.root.remove(labels)
+				continue
+			}
+			s.root.insert(labels, s.intern(item.Value))
+		}
+		return nil
+	})
+}
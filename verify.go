@@ -0,0 +1,287 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var ErrListVerification = errors.New("block list verification failed")
+
+// digest and signature files are tiny, refuse anything bigger
+const maxVerifyFileSize = 64 * 1024
+
+func (entry ListEntry) needsVerification() bool {
+	return entry.SHA256 != "" || entry.PublicKey != ""
+}
+
+func verifyError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrListVerification, fmt.Sprintf(format, args...))
+}
+
+func fetchSmall(ctx context.Context, client *http.Client, uri string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download of %s failed: %s", uri, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxVerifyFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxVerifyFileSize {
+		return nil, fmt.Errorf("%s is too large", uri)
+	}
+	return data, nil
+}
+
+// expectedDigest returns the pinned SHA-256 of a list. entry.SHA256 is
+// either the hex digest itself or the URI of a sha256sum style file.
+func expectedDigest(ctx context.Context, client *http.Client, entry ListEntry, uri string) ([]byte, error) {
+	if digest, err := hex.DecodeString(entry.SHA256); err == nil && len(digest) == sha256.Size {
+		return digest, nil
+	}
+
+	data, err := fetchSmall(ctx, client, entry.SHA256)
+	if err != nil {
+		return nil, verifyError("fetching digest: %s", err)
+	}
+
+	//sha256sum output is "<digest>  <file>", possibly for several files.
+	//take the line naming our list. A digest of another file never
+	//verifies it, only a file holding a single unnamed digest is taken
+	//as is.
+	digests := 0
+	var unnamed []byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		flds := strings.Fields(scanner.Text())
+		if len(flds) == 0 {
+			continue
+		}
+		digest, err := hex.DecodeString(flds[0])
+		if err != nil || len(digest) != sha256.Size {
+			continue
+		}
+		digests++
+		if len(flds) == 1 {
+			unnamed = digest
+		} else if path.Base(strings.TrimPrefix(flds[1], "*")) == path.Base(uri) {
+			return digest, nil
+		}
+	}
+
+	if digests == 1 && unnamed != nil {
+		return unnamed, nil
+	}
+	return nil, verifyError("no digest for %s in %s", path.Base(uri), entry.SHA256)
+}
+
+// stripComments drops the comment lines minisign puts around keys and
+// signatures, returning the remaining non empty lines.
+func stripComments(data []byte) []string {
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// parsePublicKey accepts a minisign public key or a bare base64 ed25519
+// key. keyID is nil for bare keys.
+func parsePublicKey(key string) (ed25519.PublicKey, []byte, error) {
+	lines := stripComments([]byte(key))
+	if len(lines) != 1 {
+		return nil, nil, verifyError("malformed public key")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil {
+		return nil, nil, verifyError("malformed public key: %s", err)
+	}
+
+	switch {
+	case len(raw) == 2+8+ed25519.PublicKeySize && string(raw[:2]) == "Ed":
+		return ed25519.PublicKey(raw[10:]), raw[2:10], nil
+	case len(raw) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(raw), nil, nil
+	}
+	return nil, nil, verifyError("unsupported public key")
+}
+
+// verifyMinisign checks a .minisig file. Prehashed ("ED") signatures cover
+// the BLAKE2b-512 of the list, legacy ("Ed") ones the list itself, which is
+// only read into memory for that case.
+func verifyMinisign(pub ed25519.PublicKey, keyID []byte, sigFile []byte, prehash []byte, spool *os.File) error {
+	lines := stripComments(sigFile)
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "trusted comment: ") {
+		return verifyError("malformed minisign signature")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return verifyError("malformed minisign signature")
+	}
+
+	if !bytes.Equal(sig[2:10], keyID) {
+		return verifyError("signature key id does not match public key")
+	}
+
+	var message []byte
+	switch string(sig[:2]) {
+	case "ED":
+		message = prehash
+	case "Ed":
+		message, err = readSpool(spool)
+		if err != nil {
+			return err
+		}
+	default:
+		return verifyError("unsupported signature algorithm")
+	}
+
+	if !ed25519.Verify(pub, message, sig[10:]) {
+		return verifyError("bad signature")
+	}
+
+	//the trusted comment is signed together with the signature
+	globalSig, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return verifyError("malformed minisign trusted comment signature")
+	}
+	trusted := append(append([]byte{}, sig[10:]...), strings.TrimPrefix(lines[1], "trusted comment: ")...)
+	if !ed25519.Verify(pub, trusted, globalSig) {
+		return verifyError("bad trusted comment signature")
+	}
+
+	return nil
+}
+
+// verifyEd25519 checks a bare ed25519 signature over the list, stored raw or
+// base64 encoded.
+func verifyEd25519(pub ed25519.PublicKey, sigFile []byte, spool *os.File) error {
+	sig := sigFile
+	if len(sig) != ed25519.SignatureSize {
+		lines := stripComments(sigFile)
+		if len(lines) != 1 {
+			return verifyError("malformed signature")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(lines[0])
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return verifyError("malformed signature")
+		}
+		sig = decoded
+	}
+
+	message, err := readSpool(spool)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pub, message, sig) {
+		return verifyError("bad signature")
+	}
+	return nil
+}
+
+func readSpool(spool *os.File) ([]byte, error) {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(spool)
+}
+
+// spoolVerified saves body to a temporary file and checks it against the
+// digest and public key pinned in entry. The list is verified as published,
+// before any decompression. Minisign signatures are fetched from uri +
+// ".minisig", bare ed25519 signatures from uri + ".sig". On success the file
+// is rewound for reading, the caller closes and removes it.
+func spoolVerified(ctx context.Context, client *http.Client, entry ListEntry, uri string, body io.Reader) (*os.File, error) {
+	spool, err := os.CreateTemp("", "block-list-*")
+	if err != nil {
+		return nil, err
+	}
+
+	fail := func(err error) (*os.File, error) {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, err
+	}
+
+	sha := sha256.New()
+	blake, _ := blake2b.New512(nil)
+
+	_, err = io.Copy(io.MultiWriter(spool, sha, blake), &cappedReader{r: body, remaining: gMaxDecompressedSize})
+	if err != nil {
+		return fail(err)
+	}
+
+	if entry.SHA256 != "" {
+		digest, err := expectedDigest(ctx, client, entry, uri)
+		if err != nil {
+			return fail(err)
+		}
+		if !bytes.Equal(digest, sha.Sum(nil)) {
+			return fail(verifyError("sha256 mismatch, expected %x got %x", digest, sha.Sum(nil)))
+		}
+	}
+
+	if entry.PublicKey != "" {
+		pub, keyID, err := parsePublicKey(entry.PublicKey)
+		if err != nil {
+			return fail(err)
+		}
+
+		sigURI := uri + ".sig"
+		if keyID != nil {
+			sigURI = uri + ".minisig"
+		}
+
+		sigFile, err := fetchSmall(ctx, client, sigURI)
+		if err != nil {
+			return fail(verifyError("fetching signature: %s", err))
+		}
+
+		if keyID != nil {
+			err = verifyMinisign(pub, keyID, sigFile, blake.Sum(nil), spool)
+		} else {
+			err = verifyEd25519(pub, sigFile, spool)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+
+	return spool, nil
+}
@@ -0,0 +1,116 @@
+package block
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var signedList = []byte(`
+0.0.0.0 signed.example.com
+0.0.0.0 tracker.example.net
+`)
+
+func minisignKey(t *testing.T) (ed25519.PrivateKey, string, []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte("12345678")
+	key := "untrusted comment: minisign public key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), pub...))
+	return priv, key, keyID
+}
+
+func minisign(priv ed25519.PrivateKey, keyID []byte, data []byte) []byte {
+	digest := blake2b.Sum512(data)
+	sig := ed25519.Sign(priv, digest[:])
+	comment := "timestamp:1700000000\tfile:hosts"
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), comment...))
+
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("ED"), keyID...), sig...)) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestListVerification(t *testing.T) {
+	priv, minisignPub, keyID := minisignKey(t)
+	bareSig := ed25519.Sign(priv, signedList)
+	barePub := base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+
+	digest := sha256.Sum256(signedList)
+	tampered := append([]byte("0.0.0.0 injected.example.org\n"), signedList...)
+
+	files := map[string][]byte{
+		"/hosts":                signedList,
+		"/hosts.minisig":        minisign(priv, keyID, signedList),
+		"/hosts.sig":            []byte(base64.StdEncoding.EncodeToString(bareSig)),
+		"/hosts.sha256":         []byte(hex.EncodeToString(digest[:]) + "  hosts\n"),
+		"/hosts.bare":           []byte(hex.EncodeToString(digest[:]) + "\n"),
+		"/OTHERSUMS":            []byte(hex.EncodeToString(digest[:]) + "  other\n"),
+		"/SHA256SUMS":           []byte("00" + hex.EncodeToString(digest[1:]) + "  other\n" + hex.EncodeToString(digest[:]) + "  *hosts\n"),
+		"/tampered":             tampered,
+		"/tampered.minisig":     minisign(priv, keyID, signedList),
+		"/tampered.sig":         bareSig,
+		"/hosts-badsig":         signedList,
+		"/hosts-badsig.minisig": []byte("garbage"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, exists := files[r.URL.Path]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name  string
+		entry ListEntry
+		valid bool
+	}{
+		{"pinned digest", ListEntry{URI: srv.URL + "/hosts", SHA256: hex.EncodeToString(digest[:])}, true},
+		{"digest file", ListEntry{URI: srv.URL + "/hosts", SHA256: srv.URL + "/hosts.sha256"}, true},
+		{"digest mismatch", ListEntry{URI: srv.URL + "/tampered", SHA256: srv.URL + "/hosts.sha256"}, false},
+		{"sums file picks by name", ListEntry{URI: srv.URL + "/hosts", SHA256: srv.URL + "/SHA256SUMS"}, true},
+		{"sums file without the list", ListEntry{URI: srv.URL + "/hosts", SHA256: srv.URL + "/OTHERSUMS"}, false},
+		{"bare digest file", ListEntry{URI: srv.URL + "/hosts", SHA256: srv.URL + "/hosts.bare"}, true},
+		{"missing digest file", ListEntry{URI: srv.URL + "/hosts", SHA256: srv.URL + "/missing"}, false},
+		{"minisign", ListEntry{URI: srv.URL + "/hosts", PublicKey: minisignPub}, true},
+		{"minisign tampered", ListEntry{URI: srv.URL + "/tampered", PublicKey: minisignPub}, false},
+		{"minisign malformed", ListEntry{URI: srv.URL + "/hosts-badsig", PublicKey: minisignPub}, false},
+		{"ed25519", ListEntry{URI: srv.URL + "/hosts", PublicKey: barePub}, true},
+		{"ed25519 tampered", ListEntry{URI: srv.URL + "/tampered", PublicKey: barePub}, false},
+	}
+
+	for _, test := range tests {
+		os.Remove("/tmp/verify_test.db")
+		db := BoltOpen("/tmp/verify_test.db")
+
+		b := New()
+		err := b.dbStagingDownload(db, test.entry, 0)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected list to verify, got %v", test.name, err)
+		}
+		if !test.valid {
+			if !errors.Is(err, ErrListVerification) {
+				t.Errorf("%s: expected verification failure, got %v", test.name, err)
+			}
+			if listDomainCount(db, 0) != 0 {
+				t.Errorf("%s: rejected list was stored", test.name)
+			}
+		}
+		db.Close()
+	}
+}